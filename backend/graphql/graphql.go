@@ -0,0 +1,393 @@
+// Package graphql reads and writes the riders and shipments kept in the form_data table
+// of the nhost backend, through its Hasura GraphQL API.
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/robzan8/taac/shipments"
+)
+
+// Config configures a Client.
+type Config struct {
+	Url              string        `yaml:"url"`
+	RiderSchemaId    string        `yaml:"rider_schema_id"`
+	ShipmentSchemaId string        `yaml:"shipment_schema_id"`
+	PageSize         int           `yaml:"page_size"` // rows fetched per query
+	Timeout          time.Duration `yaml:"timeout"`
+}
+
+// DefaultConfig is the configuration of the taac nhost project.
+func DefaultConfig() Config {
+	return Config{
+		Url:              "https://apfybdlkrpoqwnxchjgg.nhost.run/v1/graphql",
+		RiderSchemaId:    "4b627641-62ff-4a18-99ca-6724acfdbcb7",
+		ShipmentSchemaId: "46cceffa-3f83-4d60-bb13-0767299a8352",
+		PageSize:         100,
+		Timeout:          20 * time.Second,
+	}
+}
+
+// A Client queries the backend configured in Config. Each call takes the Authorization
+// header of the user, "Bearer <token>", so that the backend applies its permissions.
+type Client struct {
+	Config     Config
+	HTTPClient *http.Client
+
+	// If set, OnCall is called after each query, e.g. for metrics.
+	OnCall func(start time.Time, err error)
+}
+
+// NewClient returns a Client for the backend configured in conf, using http.DefaultClient.
+func NewClient(conf Config) *Client {
+	return &Client{Config: conf, HTTPClient: http.DefaultClient}
+}
+
+// QueryErrors are the errors a GraphQL response carries, with status 200.
+type QueryErrors struct {
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// Query runs query with vars and decodes the response into dest.
+func (c *Client) Query(ctx context.Context, authHeader, query string, vars map[string]interface{}, dest interface{}) (err error) {
+	if c.OnCall != nil {
+		defer func(start time.Time) { c.OnCall(start, err) }(time.Now())
+	}
+
+	varsJson := []byte("{}")
+	if len(vars) > 0 {
+		varsJson, err = json.Marshal(vars)
+		if err != nil {
+			return err
+		}
+	}
+	reqBody := fmt.Sprintf(`{"query":%q,"variables":%s}`, query, varsJson)
+	ctx, cancel := context.WithTimeout(ctx, c.Config.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Config.Url, strings.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", authHeader)
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Graphql query not ok, status: %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(dest)
+}
+
+// FormData fetches all the non deleted form_data rows with the given schema, oldest first,
+// and decodes them into dest, a pointer to a slice. Rows are fetched Config.PageSize at a time,
+// each page starting after the last row of the previous one (by created_at, then id), so that
+// rows inserted or deleted in the meantime do not make others be skipped or repeated.
+func (c *Client) FormData(ctx context.Context, authHeader, schemaId string, dest interface{}) error {
+	const query = `query($schemaId: uuid!, $limit: Int!, $createdAfter: timestamptz!, $afterId: uuid!) {
+		form_data(
+			where: {_and:[
+				{schema_id:{_eq:$schemaId}},
+				{is_deleted:{_eq:false}},
+				{_or:[
+					{created_at:{_gt:$createdAfter}},
+					{_and:[{created_at:{_eq:$createdAfter}}, {id:{_gt:$afterId}}]}
+				]}
+			]},
+			order_by: [{created_at: asc}, {id: asc}],
+			limit: $limit
+		)
+		{id user_data_ref_id data created_at}
+	}`
+	var rows []json.RawMessage
+	var last struct {
+		Id        string `json:"id"`
+		CreatedAt string `json:"created_at"`
+	}
+	last.Id, last.CreatedAt = "00000000-0000-0000-0000-000000000000", "1970-01-01T00:00:00Z"
+	for {
+		vars := map[string]interface{}{
+			"schemaId":     schemaId,
+			"limit":        c.Config.PageSize,
+			"createdAfter": last.CreatedAt,
+			"afterId":      last.Id,
+		}
+		var msg struct {
+			QueryErrors
+			Data struct {
+				Rows []json.RawMessage `json:"form_data"`
+			} `json:"data"`
+		}
+		err := c.Query(ctx, authHeader, query, vars, &msg)
+		if err != nil {
+			return err
+		}
+		if len(msg.Errors) > 0 {
+			return errors.New(msg.Errors[0].Message)
+		}
+		rows = append(rows, msg.Data.Rows...)
+		if len(msg.Data.Rows) < c.Config.PageSize {
+			break
+		}
+		err = json.Unmarshal(rows[len(rows)-1], &last)
+		if err != nil {
+			return err
+		}
+	}
+	if rows == nil {
+		rows = []json.RawMessage{}
+	}
+	all, err := json.Marshal(rows)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(all, dest)
+}
+
+// Riders fetches all the riders.
+func (c *Client) Riders(ctx context.Context, authHeader string) ([]shipments.Rider, error) {
+	var riders []shipments.Rider
+	err := c.FormData(ctx, authHeader, c.Config.RiderSchemaId, &riders)
+	return riders, err
+}
+
+// Shipments fetches all the shipments.
+func (c *Client) Shipments(ctx context.Context, authHeader string) ([]shipments.Shipment, error) {
+	var ships []shipments.Shipment
+	err := c.FormData(ctx, authHeader, c.Config.ShipmentSchemaId, &ships)
+	return ships, err
+}
+
+// Shipment fetches the shipment with the given id, nil if there is none.
+func (c *Client) Shipment(ctx context.Context, authHeader, id string) (*shipments.Shipment, error) {
+	const query = `query($schemaId: uuid!, $id: uuid!) {
+		form_data(
+			where: {_and:[
+				{id:{_eq:$id}},
+				{schema_id:{_eq:$schemaId}},
+				{is_deleted:{_eq:false}}
+			]}
+		)
+		{id user_data_ref_id data}
+	}`
+	vars := map[string]interface{}{"schemaId": c.Config.ShipmentSchemaId, "id": id}
+	var msg struct {
+		QueryErrors
+		Data struct {
+			ShipData []shipments.Shipment `json:"form_data"`
+		} `json:"data"`
+	}
+	err := c.Query(ctx, authHeader, query, vars, &msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg.Errors) > 0 {
+		return nil, errors.New(msg.Errors[0].Message)
+	}
+	if len(msg.Data.ShipData) == 0 {
+		return nil, nil
+	}
+	return &msg.Data.ShipData[0], nil
+}
+
+// UpdateShipments writes the data of ships, inserting those that do not exist.
+func (c *Client) UpdateShipments(ctx context.Context, authHeader string, ships []shipments.Shipment) error {
+	const query = `mutation($shipments: [form_data_insert_input]!) {
+		insert_form_data(
+			objects: $shipments,
+			on_conflict: {
+				constraint: form_data_pkey,
+				update_columns: [data]
+			}
+		)
+		{
+			affected_rows
+		}
+	}`
+	vars := map[string]interface{}{"shipments": ships}
+	var msg QueryErrors
+	err := c.Query(ctx, authHeader, query, vars, &msg)
+	if err != nil {
+		return err
+	}
+	if len(msg.Errors) > 0 {
+		return errors.New(msg.Errors[0].Message)
+	}
+	return nil
+}
+
+// ErrChanged is returned by UpdateShipmentsIf when shipments changed since they were read.
+var ErrChanged = errors.New("Shipments changed while they were being updated, try again")
+
+// UpdateShipmentsIf writes the data of ships, which must exist, only if none of them changed
+// since they were read: it reads them again, asks unchanged about each, and writes each one
+// on condition that its data is still the one checked. If any check or condition fails,
+// it returns ErrChanged and restores the shipments it had already written,
+// unless they changed again in the meantime.
+func (c *Client) UpdateShipmentsIf(ctx context.Context, authHeader string, ships []shipments.Shipment, unchanged func(current shipments.Shipment) bool) error {
+	if len(ships) == 0 {
+		return nil
+	}
+	const query = `query($schemaId: uuid!, $ids: [uuid!]!) {
+		form_data(
+			where: {_and:[
+				{id:{_in:$ids}},
+				{schema_id:{_eq:$schemaId}},
+				{is_deleted:{_eq:false}}
+			]}
+		)
+		{id user_data_ref_id data}
+	}`
+	var ids []string
+	for _, s := range ships {
+		ids = append(ids, s.Id)
+	}
+	vars := map[string]interface{}{"schemaId": c.Config.ShipmentSchemaId, "ids": ids}
+	var msg struct {
+		QueryErrors
+		Data struct {
+			Rows []json.RawMessage `json:"form_data"`
+		} `json:"data"`
+	}
+	err := c.Query(ctx, authHeader, query, vars, &msg)
+	if err != nil {
+		return err
+	}
+	if len(msg.Errors) > 0 {
+		return errors.New(msg.Errors[0].Message)
+	}
+	read := make(map[string]json.RawMessage) // data as read, by shipment id
+	for _, row := range msg.Data.Rows {
+		var current shipments.Shipment
+		var raw struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(row, &current); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(row, &raw); err != nil {
+			return err
+		}
+		if !unchanged(current) {
+			return ErrChanged
+		}
+		read[current.Id] = raw.Data
+	}
+
+	var updates, undos []formDataUpdate
+	for _, s := range ships {
+		old, ok := read[s.Id]
+		if !ok {
+			return ErrChanged // deleted
+		}
+		data, err := json.Marshal(s.Data)
+		if err != nil {
+			return err
+		}
+		updates = append(updates, newFormDataUpdate(s.Id, old, data))
+		undos = append(undos, newFormDataUpdate(s.Id, data, old))
+	}
+	affected, err := c.updateFormData(ctx, authHeader, updates)
+	if err != nil {
+		return err
+	}
+	var written []formDataUpdate
+	for i, n := range affected {
+		if n > 0 {
+			written = append(written, undos[i])
+		}
+	}
+	if len(written) == len(updates) {
+		return nil
+	}
+	if len(written) > 0 {
+		if _, err := c.updateFormData(ctx, authHeader, written); err != nil {
+			return fmt.Errorf("%s, and restoring the shipments already written failed: %s", ErrChanged, err)
+		}
+	}
+	return ErrChanged
+}
+
+// A formDataUpdate sets the data of a row, if it is still the expected one.
+type formDataUpdate struct {
+	Where struct {
+		Id struct {
+			Eq string `json:"_eq"`
+		} `json:"id"`
+		Data struct {
+			Eq json.RawMessage `json:"_eq"`
+		} `json:"data"`
+	} `json:"where"`
+	Set struct {
+		Data json.RawMessage `json:"data"`
+	} `json:"_set"`
+}
+
+func newFormDataUpdate(id string, expected, data json.RawMessage) formDataUpdate {
+	var u formDataUpdate
+	u.Where.Id.Eq = id
+	u.Where.Data.Eq = expected
+	u.Set.Data = data
+	return u
+}
+
+// updateFormData runs the updates in a single transaction and returns the rows affected by each.
+func (c *Client) updateFormData(ctx context.Context, authHeader string, updates []formDataUpdate) ([]int, error) {
+	const query = `mutation($updates: [form_data_updates!]!) {
+		update_form_data_many(updates: $updates) {
+			affected_rows
+		}
+	}`
+	vars := map[string]interface{}{"updates": updates}
+	var msg struct {
+		QueryErrors
+		Data struct {
+			Results []struct {
+				AffectedRows int `json:"affected_rows"`
+			} `json:"update_form_data_many"`
+		} `json:"data"`
+	}
+	err := c.Query(ctx, authHeader, query, vars, &msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg.Errors) > 0 {
+		return nil, errors.New(msg.Errors[0].Message)
+	}
+	if len(msg.Data.Results) != len(updates) {
+		return nil, fmt.Errorf("Update of %d shipments returned %d results", len(updates), len(msg.Data.Results))
+	}
+	affected := make([]int, len(updates))
+	for i, r := range msg.Data.Results {
+		affected[i] = r.AffectedRows
+	}
+	return affected, nil
+}
+
+// Ping only checks that the backend answers: without a token the query is refused.
+func (c *Client) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Config.Url, strings.NewReader(`{"query":"{__typename}"}`))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
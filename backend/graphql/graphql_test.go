@@ -0,0 +1,55 @@
+package graphql_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/robzan8/taac/backend/graphql"
+	"github.com/robzan8/taac/fake"
+	"github.com/robzan8/taac/shipments"
+)
+
+// A shipment inserted while the pages are fetched must not make others be read twice.
+func TestShipmentsPagesWhileInserting(t *testing.T) {
+	s := fake.Start()
+	defer s.Close()
+	for i := 0; i < 5; i++ {
+		var sh shipments.Shipment
+		sh.Data.Notes = fmt.Sprint(i)
+		err := s.Backend.AddShipments("user", sh)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf := graphql.DefaultConfig()
+	conf.Url, conf.PageSize = s.GraphqlUrl(), 2
+	client := graphql.NewClient(conf)
+	inserted := false
+	client.OnCall = func(time.Time, error) {
+		if !inserted {
+			inserted = true
+			var sh shipments.Shipment
+			sh.Data.Notes = "new"
+			s.Backend.AddShipments("user", sh)
+		}
+	}
+
+	ships, err := client.Shipments(context.Background(), "Bearer test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var notes []string
+	seen := make(map[string]bool)
+	for _, sh := range ships {
+		if seen[sh.Id] {
+			t.Errorf("shipment %s read twice", sh.Id)
+		}
+		seen[sh.Id] = true
+		notes = append(notes, sh.Data.Notes)
+	}
+	if got := fmt.Sprint(notes); got != "[0 1 2 3 4 new]" {
+		t.Errorf("got shipments %s, want the 5 in order and the new one", got)
+	}
+}
@@ -0,0 +1,233 @@
+// Package cassette records the HTTP traffic of a client to a file, a cassette,
+// and replays it later without the network, e.g. to reproduce locally a plan
+// computed in production from the same geocoding, routing and backend responses.
+//
+// A Recorder and a Player are http.RoundTrippers, to be used as the Transport of
+// the HTTPClient of the geocode, vrp and graphql clients:
+//
+//	rec, err := cassette.NewRecorder("traffic.jsonl", http.DefaultTransport)
+//	solver.HTTPClient = &http.Client{Transport: rec}
+//
+// API keys in the "key" query parameter and Authorization headers are not recorded.
+// Request and response bodies are, with the personal data of the recipients in them:
+// cassettes are to be handled like production data.
+package cassette
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// An Interaction is a request and its response, or the error that prevented it.
+// A cassette file holds one per line, as JSON.
+type Interaction struct {
+	Time        time.Time `json:"time"`
+	DurationMs  int64     `json:"duration_ms"`
+	Method      string    `json:"method"`
+	Url         string    `json:"url"` // without the key parameter
+	Request     string    `json:"request,omitempty"`
+	Status      int       `json:"status,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Response    string    `json:"response,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// requestKey returns the url of req without secrets and its body, leaving req readable again.
+func requestKey(req *http.Request) (string, []byte, error) {
+	u := *req.URL
+	q := u.Query()
+	q.Del("key")
+	u.RawQuery = q.Encode()
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return "", nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return u.String(), body, nil
+}
+
+// A Recorder passes requests to Transport and appends them to its cassette, with their response.
+// It is safe for concurrent use.
+type Recorder struct {
+	Transport http.RoundTripper
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewRecorder appends the traffic through transport to the cassette at path, creating it if needed.
+func NewRecorder(path string, transport http.RoundTripper) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{Transport: transport, f: f}, nil
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not change req, so the body is read from a copy.
+	req = req.Clone(req.Context())
+	reqUrl, reqBody, err := requestKey(req)
+	if err != nil {
+		return nil, err
+	}
+	in := Interaction{
+		Time:    time.Now(),
+		Method:  req.Method,
+		Url:     reqUrl,
+		Request: string(reqBody),
+	}
+	resp, err := r.Transport.RoundTrip(req)
+	if err == nil {
+		var body []byte
+		body, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		in.Status = resp.StatusCode
+		in.ContentType = resp.Header.Get("Content-Type")
+		in.Response = string(body)
+	}
+	if err != nil {
+		in.Error = err.Error()
+	}
+	in.DurationMs = time.Since(in.Time).Milliseconds()
+	if werr := r.write(in); werr != nil && err == nil {
+		err = fmt.Errorf("Recording to cassette: %s", werr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (r *Recorder) write(in Interaction) error {
+	line, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, err = r.f.Write(append(line, '\n'))
+	return err
+}
+
+func (r *Recorder) Close() error {
+	return r.f.Close()
+}
+
+// A Player answers requests with the responses recorded in a cassette, without the network.
+// A request gets the first unplayed interaction with the same method, url and body,
+// so the same request repeated gets the responses in the order they were recorded,
+// and fails once they are over. It is safe for concurrent use.
+type Player struct {
+	mu           sync.Mutex
+	interactions []Interaction
+	played       []bool
+}
+
+// Load reads the cassette at path.
+func Load(path string) (*Player, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p := new(Player)
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 64<<20) // solutions of big problems are long lines
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var in Interaction
+		err = json.Unmarshal(sc.Bytes(), &in)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		p.interactions = append(p.interactions, in)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	p.played = make([]bool, len(p.interactions))
+	return p, nil
+}
+
+func (p *Player) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	reqUrl, reqBody, err := requestKey(req)
+	if err != nil {
+		return nil, err
+	}
+	in, err := p.next(req.Method, reqUrl, string(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	if in.Error != "" {
+		return nil, fmt.Errorf("Recorded: %s", in.Error)
+	}
+	header := make(http.Header)
+	if in.ContentType != "" {
+		header.Set("Content-Type", in.ContentType)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", in.Status, http.StatusText(in.Status)),
+		StatusCode:    in.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader([]byte(in.Response))),
+		ContentLength: int64(len(in.Response)),
+		Request:       req,
+	}, nil
+}
+
+func (p *Player) next(method, reqUrl, body string) (Interaction, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	recorded := 0
+	for i, in := range p.interactions {
+		if in.Method != method || in.Url != reqUrl || in.Request != body {
+			continue
+		}
+		if !p.played[i] {
+			p.played[i] = true
+			return in, nil
+		}
+		recorded++
+	}
+	if recorded == 0 {
+		return Interaction{}, fmt.Errorf("No recorded response for %s %s", method, reqUrl)
+	}
+	return Interaction{}, fmt.Errorf("The %d recorded responses for %s %s were all replayed already", recorded, method, reqUrl)
+}
+
+// Unplayed returns the interactions not requested yet, e.g. to spot the requests
+// that went differently than when recording.
+func (p *Player) Unplayed() []Interaction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var left []Interaction
+	for i, in := range p.interactions {
+		if !p.played[i] {
+			left = append(left, in)
+		}
+	}
+	return left
+}
@@ -0,0 +1,92 @@
+package cassette
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// post posts body to url with client and returns the response body.
+func post(client *http.Client, url, body string) (string, error) {
+	resp, err := client.Post(url, "text/plain", strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return string(b), err
+}
+
+func TestRecordThenReplay(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		mu.Lock()
+		calls++
+		fmt.Fprintf(w, "%s %d", b, calls)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "traffic.jsonl")
+	url := srv.URL + "/geocode?address=Via+Po&key=secret"
+
+	rec, err := NewRecorder(path, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: rec}
+	var recorded []string
+	for _, body := range []string{"a", "a", "b"} {
+		resp, err := post(client, url, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorded = append(recorded, resp)
+	}
+	rec.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret") || strings.Count(string(data), "/geocode?address=Via+Po\"") != 3 {
+		t.Errorf("the key is in the cassette or the url is not:\n%s", data)
+	}
+
+	player, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = &http.Client{Transport: player}
+	// Replayed in another order, without the server and with another key.
+	srv.Close()
+	url = strings.Replace(url, "secret", "other", 1)
+	for _, i := range []int{2, 0, 1} {
+		body := map[int]string{0: "a", 1: "a", 2: "b"}[i]
+		resp, err := post(client, url, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp != recorded[i] {
+			t.Errorf("request %d replayed %q, want %q", i, resp, recorded[i])
+		}
+	}
+	if left := player.Unplayed(); len(left) > 0 {
+		t.Errorf("unplayed: %+v", left)
+	}
+
+	_, err = post(client, url, "a")
+	if err == nil || !strings.Contains(err.Error(), "2 recorded responses") {
+		t.Errorf("a third request a: got %v, want the responses to be over", err)
+	}
+	_, err = post(client, url, "c")
+	if err == nil || !strings.Contains(err.Error(), "No recorded response") {
+		t.Errorf("a request never recorded: got %v", err)
+	}
+}
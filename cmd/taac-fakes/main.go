@@ -0,0 +1,80 @@
+// Command taac-fakes serves the fakes of package fake, so that the server
+// can be run and tried without any external service:
+//
+//	go run ./cmd/taac-fakes -riders riders.csv -shipments shipments.csv
+//
+// It loads the riders and shipments, in the CSV formats of the taac command,
+// prints the environment for the server and a token to call it, and serves until killed.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/robzan8/taac/fake"
+	"github.com/robzan8/taac/shipments"
+	"github.com/robzan8/taac/vrp"
+)
+
+func main() {
+	var (
+		addr          = flag.String("addr", "localhost:5001", "address to listen on")
+		ridersPath    = flag.String("riders", "", "riders CSV `file` to load")
+		shipmentsPath = flag.String("shipments", "", "shipments CSV `file` to load")
+		size          = flag.Int("size", 100, "size of the loaded shipments")
+		user          = flag.String("user", "fake-user", "user id of the token and owner of the loaded data")
+		maxLocations  = flag.Int("max-locations", 30, "locations accepted by the route optimization fake, 0 for no limit")
+	)
+	flag.Parse()
+
+	s := fake.New()
+	s.Solver.MaxLocations = *maxLocations
+	if *ridersPath != "" {
+		f, err := os.Open(*ridersPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		riders, err := shipments.ReadCsvRiders(f, vrp.CargoBike.Id)
+		f.Close()
+		if err != nil {
+			log.Fatalf("%s: %s", *ridersPath, err)
+		}
+		err = s.Backend.AddRiders(*user, riders...)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *shipmentsPath != "" {
+		f, err := os.Open(*shipmentsPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ships, err := shipments.ReadCsv(f, *size)
+		f.Close()
+		if err != nil {
+			log.Fatalf("%s: %s", *shipmentsPath, err)
+		}
+		for i := range ships {
+			ships[i].Data.DeliveryStatus = shipments.StatusToBeScheduled
+		}
+		err = s.Backend.AddShipments(*user, ships...)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	fmt.Println("# Environment for the server:")
+	for _, v := range s.Env("http://" + *addr) {
+		fmt.Printf("export %s\n", v)
+	}
+	token := s.Auth.Token(*user, "", []string{"user"}, 24*time.Hour)
+	fmt.Printf("# Token, valid for a day:\nexport TOKEN=%s\n", token)
+	fmt.Printf("# e.g. curl -H \"Authorization: Bearer $TOKEN\" 'localhost:5000/schedule.txt?date=%s&dryRun=true'\n",
+		time.Now().Format(shipments.DateLayout))
+	log.Printf("Serving the geocoding, route optimization, GraphQL and JWKS fakes on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, s.Handler()))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/robzan8/taac/shipments"
+	"github.com/robzan8/taac/vrp"
+)
+
+type featureCollection struct {
+	Type     string    `json:"type"` // "FeatureCollection"
+	Features []feature `json:"features"`
+}
+
+type feature struct {
+	Type       string                 `json:"type"` // "Feature"
+	Geometry   geometry               `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geometry struct {
+	Type        string      `json:"type"`        // "Point" or "LineString"
+	Coordinates interface{} `json:"coordinates"` // [lon, lat] or a list of them
+}
+
+func point(a vrp.Address) geometry {
+	return geometry{"Point", [2]float64{a.Lon, a.Lat}}
+}
+
+// writeGeoJson writes a LineString for each route of sol, a Point for each of its stops
+// and a Point of type "unassigned" at the delivery address of each unassigned shipment.
+func writeGeoJson(w io.Writer, loc *time.Location, ships []shipments.Shipment, prob vrp.Problem, sol vrp.Solution) error {
+	shipsById := make(map[string]shipments.Shipment)
+	for _, s := range ships {
+		shipsById[s.Id] = s
+	}
+	fc := featureCollection{Type: "FeatureCollection", Features: []feature{}}
+	for _, r := range sol.Solution.Routes {
+		var line [][2]float64
+		for _, act := range r.Activities {
+			line = append(line, [2]float64{act.Address.Lon, act.Address.Lat})
+			props := map[string]interface{}{
+				"rider":   r.VehicleId,
+				"type":    act.Type,
+				"address": act.Address.Str,
+			}
+			t := act.ArrivalTime
+			if t == 0 {
+				t = act.EndTime
+			}
+			if t != 0 {
+				props["time"] = shipments.FormatTime(loc, t)
+			}
+			if act.ShipmentId != "" {
+				props["shipment"] = act.ShipmentId
+				props["notes"] = shipsById[act.ShipmentId].Data.Notes
+			}
+			fc.Features = append(fc.Features, feature{"Feature", point(act.Address), props})
+		}
+		fc.Features = append(fc.Features, feature{
+			Type:     "Feature",
+			Geometry: geometry{"LineString", line},
+			Properties: map[string]interface{}{
+				"rider":    r.VehicleId,
+				"distance": r.Distance, // in meters
+			},
+		})
+	}
+	unassigned := make(map[string]bool)
+	for _, id := range sol.Solution.Unassigned.Shipments {
+		unassigned[id] = true
+	}
+	for _, s := range prob.Shipments {
+		if !unassigned[s.Id] {
+			continue
+		}
+		fc.Features = append(fc.Features, feature{"Feature", point(s.Delivery.Address), map[string]interface{}{
+			"type":     "unassigned",
+			"address":  s.Delivery.Address.Str,
+			"shipment": s.Id,
+			"notes":    shipsById[s.Id].Data.Notes,
+		}})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(fc)
+}
@@ -0,0 +1,200 @@
+// Command taac optimizes the deliveries of a day from the command line,
+// like the /solution.csv endpoint of the server, for scripts and cron jobs:
+//
+//	taac -shipments shipments.csv -riders riders.csv -date 2022-12-31 -out routes.geojson
+//
+// The shipments CSV is the one uploaded to /solution.csv. The riders CSV has a header
+// and the columns name, start address, start and end of the shift and, optionally,
+// vehicle type. The result is written as CSV, JSON or GeoJSON.
+//
+// Settings are loaded and validated as by the server, see package config, from the
+// config file, if given, and the environment; only the geocode, routeopt,
+// vehicle_types, schedule, cassette and server.timezone ones are used.
+//
+// With -record (or cassette.record), the geocoding and route optimization traffic
+// is saved to a cassette file; with -replay (or cassette.replay), it is served from
+// one instead, e.g. recorded by the server, to reproduce a plan offline and without
+// keys. See package cassette.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/robzan8/taac/cassette"
+	"github.com/robzan8/taac/config"
+	"github.com/robzan8/taac/geocode"
+	"github.com/robzan8/taac/shipments"
+	"github.com/robzan8/taac/vrp"
+)
+
+func main() {
+	var (
+		configPath     = flag.String("config", os.Getenv("CONFIG_FILE"), "server YAML config `file`, overridden by the environment")
+		shipmentsPath  = flag.String("shipments", "", "shipments CSV `file`")
+		ridersPath     = flag.String("riders", "", "riders CSV `file`")
+		date           = flag.String("date", "", "day of the deliveries, as 2022-12-31 (default today)")
+		parcelsPerBike = flag.Int("parcels-per-bike", 10, "how many shipments fit in a vehicle")
+		format         = flag.String("format", "", "output format: csv, json or geojson (default from the -out extension, or csv)")
+		outPath        = flag.String("out", "", "output `file` (default standard output)")
+		timeout        = flag.Duration("timeout", 10*time.Minute, "give up after this long")
+		recordPath     = flag.String("record", "", "cassette `file` to record the geocoding and route optimization traffic to")
+		replayPath     = flag.String("replay", "", "cassette `file` to replay the geocoding and route optimization traffic from")
+	)
+	flag.Parse()
+
+	err := run(*configPath, *shipmentsPath, *ridersPath, *date, *parcelsPerBike, *format, *outPath, *timeout,
+		*recordPath, *replayPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "taac: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(configPath, shipmentsPath, ridersPath, date string, parcelsPerBike int, format, outPath string, timeout time.Duration,
+	recordPath, replayPath string) error {
+	if shipmentsPath == "" || ridersPath == "" {
+		return errors.New("-shipments and -riders are required")
+	}
+	if parcelsPerBike < 1 || parcelsPerBike > 100 {
+		return errors.New("-parcels-per-bike must be between 1 and 100")
+	}
+	if format == "" {
+		format = strings.TrimPrefix(filepath.Ext(outPath), ".")
+		if format != "json" && format != "geojson" {
+			format = "csv"
+		}
+	}
+	if format != "csv" && format != "json" && format != "geojson" {
+		return fmt.Errorf("Unknown format %q", format)
+	}
+	conf, err := loadConfig(configPath, recordPath, replayPath)
+	if err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation(conf.Server.Timezone)
+	if err != nil {
+		return fmt.Errorf("Invalid timezone: %s", err)
+	}
+	if date == "" {
+		date = time.Now().In(loc).Format(shipments.DateLayout)
+	}
+	if _, err := time.Parse(shipments.DateLayout, date); err != nil {
+		return errors.New("-date must be in the format 2022-12-31")
+	}
+
+	geocoder, solver := geocode.NewClient(conf.Geocode), vrp.NewSolver(conf.Routeopt)
+	var player *cassette.Player
+	switch {
+	case conf.Cassette.Record != "":
+		rec, err := cassette.NewRecorder(conf.Cassette.Record, http.DefaultTransport)
+		if err != nil {
+			return err
+		}
+		defer rec.Close()
+		geocoder.HTTPClient = &http.Client{Transport: rec}
+		solver.HTTPClient = geocoder.HTTPClient
+	case conf.Cassette.Replay != "":
+		player, err = cassette.Load(conf.Cassette.Replay)
+		if err != nil {
+			return err
+		}
+		geocoder.HTTPClient = &http.Client{Transport: player}
+		solver.HTTPClient = geocoder.HTTPClient
+	}
+	planner := shipments.NewPlanner(geocoder, solver, loc)
+	planner.VehicleTypes = conf.VehicleTypes
+	planner.PickupTime = conf.Schedule.PickupTime
+	planner.DeliveryTime = conf.Schedule.DeliveryTime
+
+	f, err := os.Open(ridersPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	riders, err := shipments.ReadCsvRiders(f, conf.VehicleTypes[0].Id)
+	if err != nil {
+		return fmt.Errorf("%s: %s", ridersPath, err)
+	}
+	f, err = os.Open(shipmentsPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	ships, err := shipments.ReadCsv(f, conf.VehicleTypes[0].Capacity[0]/parcelsPerBike)
+	if err != nil {
+		return fmt.Errorf("%s: %s", shipmentsPath, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	prob, err := planner.Problem(ctx, riders, ships, date)
+	if err != nil {
+		return err
+	}
+	sol, err := planner.Solve(ctx, prob, ships, date)
+	if err != nil {
+		return err
+	}
+	if n := len(sol.Solution.Unassigned.Shipments); n > 0 {
+		fmt.Fprintf(os.Stderr, "taac: %d shipments could not be assigned\n", n)
+	}
+	if player != nil {
+		if n := len(player.Unplayed()); n > 0 {
+			fmt.Fprintf(os.Stderr, "taac: %d recorded requests were not replayed, the plan may differ\n", n)
+		}
+	}
+
+	var out bytes.Buffer
+	switch format {
+	case "csv":
+		err = shipments.WriteCsv(&out, ships)
+	case "json":
+		err = writeJson(&out, date, ships, sol)
+	case "geojson":
+		err = writeGeoJson(&out, loc, ships, prob, sol)
+	}
+	if err != nil {
+		return err
+	}
+	if outPath == "" {
+		_, err = os.Stdout.Write(out.Bytes())
+		return err
+	}
+	return os.WriteFile(outPath, out.Bytes(), 0666)
+}
+
+// loadConfig loads the configuration as the server does, with the cassette
+// files of the flags, if given, taking the place of the configured ones.
+func loadConfig(path, recordPath, replayPath string) (config.Config, error) {
+	c, err := config.Load(path)
+	if err != nil {
+		return c, err
+	}
+	if recordPath != "" || replayPath != "" {
+		c.Cassette.Record, c.Cassette.Replay = recordPath, replayPath
+	}
+	return c, c.Validate(false)
+}
+
+// writeJson writes the scheduled shipments together with the routes of sol.
+func writeJson(w io.Writer, date string, ships []shipments.Shipment, sol vrp.Solution) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Date       string               `json:"date"`
+		Shipments  []shipments.Shipment `json:"shipments"`
+		Routes     []vrp.Route          `json:"routes"`
+		Unassigned []string             `json:"unassigned"`
+	}{date, ships, sol.Solution.Routes, sol.Solution.Unassigned.Shipments})
+}
@@ -0,0 +1,409 @@
+// Package config loads the configuration of the server and of the command taac:
+// a YAML file, see taac.example.yaml, overridden by the environment variables
+// documented in the README. Both go through Load and Validate, so that the same
+// file and environment mean the same settings to either.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robzan8/taac/backend/graphql"
+	"github.com/robzan8/taac/geocode"
+	"github.com/robzan8/taac/shipments"
+	"github.com/robzan8/taac/vrp"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the whole configuration of the server. The command taac uses the
+// geocode, routeopt, vehicle_types, schedule, cassette and server.timezone settings.
+type Config struct {
+	Server   Server         `yaml:"server"`
+	Auth     Auth           `yaml:"auth"`
+	Graphql  graphql.Config `yaml:"graphql"`
+	Geocode  geocode.Config `yaml:"geocode"`
+	Routeopt vrp.Config     `yaml:"routeopt"`
+	// The first one is used by /solution.csv.
+	VehicleTypes []vrp.VehicleType `yaml:"vehicle_types"`
+	Schedule     Schedule          `yaml:"schedule"`
+	Tracking     Tracking          `yaml:"tracking"`
+	Kpi          Kpi               `yaml:"kpi"`
+	Notify       Notify            `yaml:"notify"`
+	Webhooks     []Webhook         `yaml:"webhooks"`
+	Storage      Storage           `yaml:"storage"`
+	Cassette     Cassette          `yaml:"cassette"`
+}
+
+type Server struct {
+	Port            string        `yaml:"port"`
+	Password        string        `yaml:"password"` // for /solution.csv and the history
+	Timezone        string        `yaml:"timezone"` // of the times of day in input
+	CsvOrigins      []string      `yaml:"csv_origins"`
+	ScheduleOrigins []string      `yaml:"schedule_origins"`
+	HistoryDb       string        `yaml:"history_db"`
+	ReadTimeout     time.Duration `yaml:"read_timeout"`
+	WriteTimeout    time.Duration `yaml:"write_timeout"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+type Auth struct {
+	JwksUrl    string        `yaml:"jwks_url"`
+	Issuer     string        `yaml:"issuer"`      // iss claim the tokens must have, if set
+	Roles      []string      `yaml:"roles"`       // Hasura roles allowed to call the API
+	AdminRoles []string      `yaml:"admin_roles"` // those also allowed to see and replay webhook deliveries
+	Timeout    time.Duration `yaml:"timeout"`
+}
+
+type Schedule struct {
+	MaxRidersPerDay int           `yaml:"max_riders_per_day"`
+	MaxDays         int           `yaml:"max_days"`
+	PickupTime      time.Duration `yaml:"pickup_time"`   // spent at each pickup
+	DeliveryTime    time.Duration `yaml:"delivery_time"` // spent at each delivery
+	PlanTtl         time.Duration `yaml:"plan_ttl"`
+}
+
+type Tracking struct {
+	RiderSpeed   float64       `yaml:"rider_speed"`      // average with speed factor 1, in km/h
+	DetourFactor float64       `yaml:"detour_factor"`    // ratio of road distance to straight line
+	MaxAge       time.Duration `yaml:"max_position_age"` // older positions are ignored by the ETAs
+}
+
+type Kpi struct {
+	VanCo2PerKm float64       `yaml:"van_co2_g_per_km"`
+	OnTime      time.Duration `yaml:"on_time_tolerance"`
+}
+
+type Notify struct {
+	SmtpAddr     string        `yaml:"smtp_addr"`
+	SmtpFrom     string        `yaml:"smtp_from"`
+	SmtpUser     string        `yaml:"smtp_user"`
+	SmtpPassword string        `yaml:"smtp_password"`
+	SmtpTimeout  time.Duration `yaml:"smtp_timeout"` // for the whole conversation with the server
+	SmsUrl       string        `yaml:"sms_gateway_url"`
+	SmsKey       string        `yaml:"sms_gateway_key"`
+	SmsTimeout   time.Duration `yaml:"sms_timeout"`
+}
+
+type Storage struct {
+	Kind        string        `yaml:"kind"` // fs or s3
+	Dir         string        `yaml:"dir"`
+	S3Endpoint  string        `yaml:"s3_endpoint"`
+	S3Bucket    string        `yaml:"s3_bucket"`
+	S3Region    string        `yaml:"s3_region"`
+	S3AccessKey string        `yaml:"s3_access_key"`
+	S3SecretKey string        `yaml:"s3_secret_key"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+// Outbound traffic of the geocoder, solver and backend, see package cassette.
+type Cassette struct {
+	Record string `yaml:"record"` // file to append the traffic to
+	Replay string `yaml:"replay"` // file to serve it from, instead of the services
+}
+
+// Default returns the defaults of the settings, those of taac.example.yaml.
+func Default() Config {
+	var c Config
+	c.Server.Timezone = "Europe/Rome"
+	c.Server.HistoryDb = "./taac.db"
+	c.Server.ReadTimeout = time.Minute
+	c.Server.WriteTimeout = 2 * time.Minute
+	c.Server.IdleTimeout = 2 * time.Minute
+	c.Server.ShutdownTimeout = 25 * time.Second // Heroku kills the process 30s after SIGTERM
+	c.Auth.Roles = []string{"user"}
+	c.Auth.AdminRoles = []string{"admin"}
+	c.Auth.Timeout = 10 * time.Second
+	c.Graphql = graphql.DefaultConfig()
+	c.Geocode = geocode.DefaultConfig()
+	c.Routeopt = vrp.DefaultConfig()
+	c.VehicleTypes = []vrp.VehicleType{vrp.CargoBike}
+	c.Schedule.MaxRidersPerDay = 2
+	c.Schedule.MaxDays = 14
+	c.Schedule.PickupTime = shipments.DefaultPickupTime
+	c.Schedule.DeliveryTime = shipments.DefaultDeliveryTime
+	c.Schedule.PlanTtl = time.Hour
+	c.Tracking.RiderSpeed = 17 // 12 for the default cargo bike
+	c.Tracking.DetourFactor = 1.3
+	c.Tracking.MaxAge = 15 * time.Minute
+	c.Kpi.VanCo2PerKm = 200
+	c.Kpi.OnTime = 15 * time.Minute
+	c.Notify.SmtpFrom = "taac@localhost"
+	c.Notify.SmtpTimeout = 30 * time.Second
+	c.Notify.SmsTimeout = 10 * time.Second
+	c.Storage.Kind = "fs"
+	c.Storage.Dir = "./pod"
+	c.Storage.S3Region = "us-east-1"
+	c.Storage.Timeout = 30 * time.Second
+	return c
+}
+
+// Load reads the config file at path, if any, over the defaults,
+// then applies the environment variables. See Validate for the checks.
+func Load(path string) (Config, error) {
+	c := Default()
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return c, err
+		}
+		defer f.Close()
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true) // catch typos in the names
+		err = dec.Decode(&c)
+		if err != nil {
+			return c, fmt.Errorf("Config file %s: %s", path, err)
+		}
+	}
+	return c, invalid(c.applyEnv())
+}
+
+// Validate checks c, with the settings needed to serve only if server is set.
+func (c *Config) Validate(server bool) error {
+	return invalid(c.validate(server))
+}
+
+// invalid lists errs in a single error, if any.
+func invalid(errs []string) error {
+	if len(errs) > 0 {
+		return fmt.Errorf("Invalid configuration:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// applyEnv overrides c with the environment variables that are set.
+func (c *Config) applyEnv() (errs []string) {
+	str := func(name string, dst *string) {
+		if v := os.Getenv(name); v != "" {
+			*dst = v
+		}
+	}
+	list := func(name string, dst *[]string) {
+		if v := os.Getenv(name); v != "" {
+			*dst = splitList(v)
+		}
+	}
+	integer := func(name string, dst *int) {
+		if v := os.Getenv(name); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s must be an integer", name))
+				return
+			}
+			*dst = i
+		}
+	}
+	float := func(name string, dst *float64) {
+		if v := os.Getenv(name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s must be a number", name))
+				return
+			}
+			*dst = f
+		}
+	}
+
+	str("PORT", &c.Server.Port)
+	str("PASSWORD", &c.Server.Password)
+	str("TIMEZONE", &c.Server.Timezone)
+	list("CSV_ORIGINS", &c.Server.CsvOrigins)
+	list("SCHEDULE_ORIGINS", &c.Server.ScheduleOrigins)
+	str("HISTORY_DB", &c.Server.HistoryDb)
+	str("JWKS_URL", &c.Auth.JwksUrl)
+	str("JWT_ISSUER", &c.Auth.Issuer)
+	list("JWT_ROLES", &c.Auth.Roles)
+	list("JWT_ADMIN_ROLES", &c.Auth.AdminRoles)
+	str("GRAPHQL_URL", &c.Graphql.Url)
+	str("RIDER_SCHEMA_ID", &c.Graphql.RiderSchemaId)
+	str("SHIPMENT_SCHEMA_ID", &c.Graphql.ShipmentSchemaId)
+	integer("GRAPHQL_PAGE_SIZE", &c.Graphql.PageSize)
+	str("GEOCODE_URL", &c.Geocode.Url)
+	str("GEOCODE_KEY", &c.Geocode.Key)
+	str("ROUTEOPT_URL", &c.Routeopt.Url)
+	str("ROUTEOPT_KEY", &c.Routeopt.Key)
+	integer("ROUTEOPT_MAX_LOCATIONS", &c.Routeopt.MaxLocations)
+	integer("MAX_RIDERS_PER_DAY", &c.Schedule.MaxRidersPerDay)
+	float("VAN_CO2_G_PER_KM", &c.Kpi.VanCo2PerKm)
+	str("SMTP_ADDR", &c.Notify.SmtpAddr)
+	str("SMTP_FROM", &c.Notify.SmtpFrom)
+	str("SMTP_USER", &c.Notify.SmtpUser)
+	str("SMTP_PASSWORD", &c.Notify.SmtpPassword)
+	str("SMS_GATEWAY_URL", &c.Notify.SmsUrl)
+	str("SMS_GATEWAY_KEY", &c.Notify.SmsKey)
+	str("POD_STORAGE", &c.Storage.Kind)
+	str("POD_DIR", &c.Storage.Dir)
+	str("S3_ENDPOINT", &c.Storage.S3Endpoint)
+	str("S3_BUCKET", &c.Storage.S3Bucket)
+	str("S3_REGION", &c.Storage.S3Region)
+	str("S3_ACCESS_KEY", &c.Storage.S3AccessKey)
+	str("S3_SECRET_KEY", &c.Storage.S3SecretKey)
+	str("CASSETTE_RECORD", &c.Cassette.Record)
+	str("CASSETTE_REPLAY", &c.Cassette.Replay)
+	if v := os.Getenv("WEBHOOKS"); v != "" {
+		c.Webhooks = nil
+		if err := json.Unmarshal([]byte(v), &c.Webhooks); err != nil {
+			errs = append(errs, fmt.Sprintf("WEBHOOKS must be a JSON array of webhooks: %s", err))
+		}
+	}
+	return errs
+}
+
+// validate returns a message for each problem of c, naming the setting as in the file.
+func (c *Config) validate(server bool) (errs []string) {
+	required := func(name, value, env string) {
+		if value == "" {
+			errs = append(errs, fmt.Sprintf("%s must be set (or %s)", name, env))
+		}
+	}
+	positive := func(name string, value float64) {
+		if value <= 0 {
+			errs = append(errs, fmt.Sprintf("%s must be positive", name))
+		}
+	}
+
+	if server {
+		required("server.port", c.Server.Port, "PORT")
+		required("server.password", c.Server.Password, "PASSWORD")
+		required("auth.jwks_url", c.Auth.JwksUrl, "JWKS_URL")
+	}
+	if c.Cassette.Replay == "" {
+		required("geocode.key", c.Geocode.Key, "GEOCODE_KEY")
+		required("routeopt.key", c.Routeopt.Key, "ROUTEOPT_KEY")
+	} else if c.Cassette.Record != "" {
+		errs = append(errs, "cassette.record and cassette.replay cannot be both set")
+	}
+	if _, err := time.LoadLocation(c.Server.Timezone); err != nil {
+		errs = append(errs, fmt.Sprintf("server.timezone: %s", err))
+	}
+	if len(c.Auth.Roles) == 0 {
+		errs = append(errs, "auth.roles must not be empty")
+	}
+	positive("graphql.page_size", float64(c.Graphql.PageSize))
+	positive("geocode.cache_size", float64(c.Geocode.CacheSize))
+	if m := c.Routeopt.MaxLocations; m < 0 || m == 1 || m == 2 {
+		errs = append(errs, "routeopt.max_locations must be 0 or an integer greater than 2")
+	}
+	if len(c.VehicleTypes) == 0 {
+		errs = append(errs, "vehicle_types must not be empty")
+	}
+	for i, vt := range c.VehicleTypes {
+		if vt.Id == "" || vt.Profile == "" || vt.Capacity[0] <= 0 || vt.SpeedFactor <= 0 {
+			errs = append(errs, fmt.Sprintf("vehicle_types[%d] needs type_id, profile, a positive capacity and speed_factor", i))
+		}
+	}
+	positive("schedule.max_riders_per_day", float64(c.Schedule.MaxRidersPerDay))
+	positive("schedule.max_days", float64(c.Schedule.MaxDays))
+	if c.Schedule.PickupTime < 0 || c.Schedule.DeliveryTime < 0 {
+		errs = append(errs, "schedule.pickup_time and schedule.delivery_time must not be negative")
+	}
+	positive("tracking.rider_speed", c.Tracking.RiderSpeed)
+	if c.Tracking.DetourFactor < 1 {
+		errs = append(errs, "tracking.detour_factor must be at least 1")
+	}
+	if c.Kpi.VanCo2PerKm < 0 {
+		errs = append(errs, "kpi.van_co2_g_per_km must not be negative")
+	}
+	for i, h := range c.Webhooks {
+		if h.Url == "" {
+			errs = append(errs, fmt.Sprintf("webhooks[%d] has no url", i))
+		}
+		if h.Org == "" {
+			errs = append(errs, fmt.Sprintf("webhooks[%d] has no organization", i))
+		}
+	}
+	switch c.Storage.Kind {
+	case "fs":
+		required("storage.dir", c.Storage.Dir, "POD_DIR")
+	case "s3":
+		if c.Storage.S3Endpoint == "" || c.Storage.S3Bucket == "" || c.Storage.S3AccessKey == "" || c.Storage.S3SecretKey == "" {
+			errs = append(errs, "storage.s3_endpoint, s3_bucket, s3_access_key and s3_secret_key must be set with storage.kind s3")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("storage.kind must be fs or s3, not %q", c.Storage.Kind))
+	}
+	for name, d := range map[string]time.Duration{
+		"server.read_timeout":       c.Server.ReadTimeout,
+		"server.write_timeout":      c.Server.WriteTimeout,
+		"server.idle_timeout":       c.Server.IdleTimeout,
+		"server.shutdown_timeout":   c.Server.ShutdownTimeout,
+		"auth.timeout":              c.Auth.Timeout,
+		"graphql.timeout":           c.Graphql.Timeout,
+		"geocode.timeout":           c.Geocode.Timeout,
+		"routeopt.timeout":          c.Routeopt.Timeout,
+		"schedule.plan_ttl":         c.Schedule.PlanTtl,
+		"tracking.max_position_age": c.Tracking.MaxAge,
+		"kpi.on_time_tolerance":     c.Kpi.OnTime,
+		"notify.smtp_timeout":       c.Notify.SmtpTimeout,
+		"notify.sms_timeout":        c.Notify.SmsTimeout,
+		"storage.timeout":           c.Storage.Timeout,
+	} {
+		if d <= 0 {
+			errs = append(errs, fmt.Sprintf("%s must be a positive duration, e.g. 30s", name))
+		}
+	}
+	return errs
+}
+
+// Summary describes c as YAML, without secrets.
+func (c Config) Summary() string {
+	mask := func(secret string) string {
+		if secret == "" {
+			return ""
+		}
+		return "***"
+	}
+	c.Server.Password = mask(c.Server.Password)
+	c.Geocode.Key = mask(c.Geocode.Key)
+	c.Routeopt.Key = mask(c.Routeopt.Key)
+	c.Notify.SmtpPassword = mask(c.Notify.SmtpPassword)
+	c.Notify.SmsKey = mask(c.Notify.SmsKey)
+	c.Storage.S3SecretKey = mask(c.Storage.S3SecretKey)
+	hooks := make([]Webhook, len(c.Webhooks))
+	for i, h := range c.Webhooks {
+		h.Secret = mask(h.Secret)
+		hooks[i] = h
+	}
+	c.Webhooks = hooks
+	out, err := yaml.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
+
+// A Webhook receives the events of its organization it subscribed to, all of them if Events is empty.
+type Webhook struct {
+	Url    string   `json:"url" yaml:"url"`
+	Secret string   `json:"secret" yaml:"secret"`
+	Events []string `json:"events" yaml:"events"`
+	// The organization id of the tokens, or "user:" and the user id if they have none.
+	Org string `json:"organization" yaml:"organization"`
+}
+
+func (h Webhook) Wants(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			items = append(items, s)
+		}
+	}
+	return items
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "taac.yaml")
+	err := os.WriteFile(path, []byte(yaml), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadEmptyVariablesDoNotOverride(t *testing.T) {
+	path := writeConfig(t, "geocode:\n  key: from-file\n")
+	t.Setenv("GEOCODE_KEY", "")
+	t.Setenv("ROUTEOPT_KEY", "from-env")
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Geocode.Key != "from-file" || c.Routeopt.Key != "from-env" {
+		t.Errorf("geocode key %q and routeopt key %q, want from-file and from-env", c.Geocode.Key, c.Routeopt.Key)
+	}
+}
+
+func TestLoadUnknownField(t *testing.T) {
+	_, err := Load(writeConfig(t, "geocode:\n  kye: typo\n"))
+	if err == nil || !strings.Contains(err.Error(), "kye") {
+		t.Errorf("got %v, want an error about kye", err)
+	}
+}
+
+// The command taac needs neither a port nor a password nor the JWKS.
+func TestValidate(t *testing.T) {
+	c := Default()
+	c.Geocode.Key, c.Routeopt.Key = "key", "key"
+	if err := c.Validate(false); err != nil {
+		t.Errorf("valid without the server settings: %v", err)
+	}
+	err := c.Validate(true)
+	for _, name := range []string{"server.port", "server.password", "auth.jwks_url"} {
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("got %v, want an error about %s", err, name)
+		}
+	}
+
+	c.VehicleTypes = nil
+	c.Cassette.Replay = "cassette.jsonl"
+	c.Geocode.Key, c.Routeopt.Key = "", ""
+	err = c.Validate(false)
+	if err == nil || !strings.Contains(err.Error(), "vehicle_types") || strings.Contains(err.Error(), "key") {
+		t.Errorf("got %v, want only an error about vehicle_types when replaying", err)
+	}
+}
@@ -0,0 +1,93 @@
+// Package fake implements in-memory fakes of the services taac depends on:
+// the Google Geocoding API, the GraphHopper route optimization API, the nhost
+// GraphQL form_data queries and mutations, and the nhost JWKS with tokens to match.
+// Pointing the server or the library clients at them runs every flow offline.
+//
+// The fakes answer at the paths of the real services, under a single base url:
+//
+//	s := fake.Start()
+//	defer s.Close()
+//	geocoder := geocode.NewClient(geocode.Config{Url: s.GeocodeUrl(), ...})
+package fake
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+)
+
+// Paths of the services, as in the real ones.
+const (
+	GeocodePath = "/maps/api/geocode/json"
+	VrpPath     = "/api/1/vrp"
+	GraphqlPath = "/v1/graphql"
+	JwksPath    = "/v1/auth/.well-known/jwks.json"
+)
+
+// Services bundles the fakes. Their fields can be changed before the first request.
+type Services struct {
+	Geocoder *Geocoder
+	Solver   *Solver
+	Backend  *Backend
+	Auth     *Auth
+
+	// Set by Start.
+	Server *httptest.Server
+}
+
+// New returns the fakes, without data.
+func New() *Services {
+	return &Services{
+		Geocoder: NewGeocoder(),
+		Solver:   NewSolver(),
+		Backend:  NewBackend(),
+		Auth:     NewAuth(),
+	}
+}
+
+// Start returns the fakes, served by an httptest server on a local port.
+func Start() *Services {
+	s := New()
+	s.Server = httptest.NewServer(s.Handler())
+	return s
+}
+
+func (s *Services) Close() {
+	if s.Server != nil {
+		s.Server.Close()
+	}
+}
+
+// Handler serves all the fakes at their paths.
+func (s *Services) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(GeocodePath, s.Geocoder)
+	mux.Handle(VrpPath, s.Solver)
+	mux.Handle(GraphqlPath, s.Backend)
+	mux.Handle(JwksPath, s.Auth)
+	return mux
+}
+
+func (s *Services) GeocodeUrl() string { return s.Server.URL + GeocodePath }
+func (s *Services) VrpUrl() string     { return s.Server.URL + VrpPath }
+func (s *Services) GraphqlUrl() string { return s.Server.URL + GraphqlPath }
+func (s *Services) JwksUrl() string    { return s.Server.URL + JwksPath }
+
+// Env returns the environment variables that point the server to the fakes served at baseUrl,
+// with all it needs to start: it listens on port 5000 and its password is "fake".
+func (s *Services) Env(baseUrl string) []string {
+	return []string{
+		"PORT=5000",
+		"PASSWORD=fake",
+		"GEOCODE_URL=" + baseUrl + GeocodePath,
+		"GEOCODE_KEY=fake",
+		"ROUTEOPT_URL=" + baseUrl + VrpPath,
+		"ROUTEOPT_KEY=fake",
+		fmt.Sprintf("ROUTEOPT_MAX_LOCATIONS=%d", s.Solver.MaxLocations),
+		"GRAPHQL_URL=" + baseUrl + GraphqlPath,
+		"RIDER_SCHEMA_ID=" + s.Backend.RiderSchemaId,
+		"SHIPMENT_SCHEMA_ID=" + s.Backend.ShipmentSchemaId,
+		"JWKS_URL=" + baseUrl + JwksPath,
+		"JWT_ISSUER=" + s.Auth.Issuer,
+	}
+}
@@ -0,0 +1,91 @@
+package fake
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"sync"
+
+	"github.com/robzan8/taac/geocode"
+)
+
+// A Geocoder fakes the Google Geocoding API. Addresses in Locations get their location,
+// the others a made up but stable one within about 5km of Center. Addresses in
+// NotFound, and the empty one, have no results.
+type Geocoder struct {
+	Center    geocode.Location
+	Locations map[string]geocode.Location
+	NotFound  map[string]bool
+
+	mu       sync.Mutex
+	requests int
+}
+
+func NewGeocoder() *Geocoder {
+	return &Geocoder{
+		Center:    geocode.Location{Lat: 45.4642, Lon: 9.19}, // Milan
+		Locations: make(map[string]geocode.Location),
+		NotFound:  make(map[string]bool),
+	}
+}
+
+// Requests counts the requests served, e.g. to check the cache of the client.
+func (g *Geocoder) Requests() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.requests
+}
+
+// Locate returns the location the fake gives to addr, false if it has none.
+func (g *Geocoder) Locate(addr string) (geocode.Location, bool) {
+	if addr == "" || g.NotFound[addr] {
+		return geocode.Location{}, false
+	}
+	if loc, ok := g.Locations[addr]; ok {
+		return loc, true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(addr))
+	sum := h.Sum64()
+	// Offsets of up to ±0.045°, about 5km.
+	dLat := float64(sum%9001)/100000 - 0.045
+	dLon := float64(sum/9001%9001)/100000 - 0.045
+	return geocode.Location{Lat: g.Center.Lat + dLat, Lon: g.Center.Lon + dLon}, true
+}
+
+func (g *Geocoder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	g.mu.Lock()
+	g.requests++
+	g.mu.Unlock()
+
+	type result struct {
+		Geometry struct {
+			Location geocode.Location `json:"location"`
+		} `json:"geometry"`
+	}
+	var res struct {
+		Status   string   `json:"status"`
+		ErrorMsg string   `json:"error_message,omitempty"`
+		Results  []result `json:"results"`
+	}
+	res.Results = []result{}
+	w.Header().Set("Content-Type", "application/json")
+	if req.FormValue("key") == "" {
+		res.Status = "REQUEST_DENIED"
+		res.ErrorMsg = "You must use an API key to authenticate each request to Google Maps Platform APIs."
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	loc, ok := g.Locate(req.FormValue("address"))
+	if !ok {
+		res.Status = "ZERO_RESULTS"
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	res.Status = "OK"
+	var r result
+	r.Geometry.Location = loc
+	res.Results = append(res.Results, r)
+	json.NewEncoder(w).Encode(res)
+}
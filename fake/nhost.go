@@ -0,0 +1,343 @@
+package fake
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robzan8/taac/backend/graphql"
+	"github.com/robzan8/taac/shipments"
+)
+
+// A Row of the form_data table.
+type Row struct {
+	Id        string          `json:"id"`
+	User      string          `json:"user_data_ref_id"`
+	Schema    string          `json:"schema_id"`
+	Data      json.RawMessage `json:"data"`
+	Deleted   bool            `json:"is_deleted"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// A Backend fakes the nhost GraphQL API, for the form_data queries and mutations
+// of the graphql package. Every request needs an Authorization header,
+// but tokens are not verified and every user sees all the rows.
+type Backend struct {
+	RiderSchemaId    string
+	ShipmentSchemaId string
+
+	mu      sync.Mutex
+	rows    []Row
+	nextId  int
+	queries int
+}
+
+// NewBackend returns an empty backend with the schema ids of graphql.DefaultConfig.
+func NewBackend() *Backend {
+	conf := graphql.DefaultConfig()
+	return &Backend{RiderSchemaId: conf.RiderSchemaId, ShipmentSchemaId: conf.ShipmentSchemaId}
+}
+
+// Add inserts a row with the given schema, owned by user, and returns its new id.
+func (b *Backend) Add(schemaId, user string, data interface{}) (string, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextId++
+	id := fmt.Sprintf("00000000-0000-4000-8000-%012d", b.nextId)
+	b.rows = append(b.rows, Row{
+		Id:        id,
+		User:      user,
+		Schema:    schemaId,
+		Data:      raw,
+		CreatedAt: time.Now().Add(time.Duration(b.nextId) * time.Millisecond),
+	})
+	return id, nil
+}
+
+// AddRiders inserts riders, owned by user, with new ids.
+func (b *Backend) AddRiders(user string, riders ...shipments.Rider) error {
+	for _, r := range riders {
+		_, err := b.Add(b.RiderSchemaId, user, r.Data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddShipments inserts ships, owned by user, with new ids.
+func (b *Backend) AddShipments(user string, ships ...shipments.Shipment) error {
+	for _, s := range ships {
+		_, err := b.Add(b.ShipmentSchemaId, user, s.Data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shipments returns the current shipments, e.g. to check what a request wrote.
+func (b *Backend) Shipments() ([]shipments.Shipment, error) {
+	var ships []shipments.Shipment
+	for _, r := range b.Rows(b.ShipmentSchemaId) {
+		var s shipments.Shipment
+		s.Id, s.User, s.Schema = r.Id, r.User, r.Schema
+		err := json.Unmarshal(r.Data, &s.Data)
+		if err != nil {
+			return nil, err
+		}
+		ships = append(ships, s)
+	}
+	return ships, nil
+}
+
+// Rows returns a copy of the non deleted rows with the given schema, in insertion order.
+func (b *Backend) Rows(schemaId string) []Row {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var rows []Row
+	for _, r := range b.rows {
+		if r.Schema == schemaId && !r.Deleted {
+			rows = append(rows, r)
+		}
+	}
+	return rows
+}
+
+// Queries counts the queries and mutations served.
+func (b *Backend) Queries() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.queries
+}
+
+func (b *Backend) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Query     string `json:"query"`
+		Variables struct {
+			SchemaId string   `json:"schemaId"`
+			Id       string   `json:"id"`
+			Ids      []string `json:"ids"`
+			Limit    *int     `json:"limit"`
+			// The keyset of FormData: only rows after these, by created_at and id.
+			CreatedAfter *time.Time   `json:"createdAfter"`
+			AfterId      string       `json:"afterId"`
+			Shipments    []Row        `json:"shipments"`
+			Updates      []dataUpdate `json:"updates"`
+		} `json:"variables"`
+	}
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		graphqlError(w, "invalid request: "+err.Error())
+		return
+	}
+	if req.Header.Get("Authorization") == "" {
+		graphqlError(w, "Missing Authorization header in JWT authentication mode")
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.queries++
+	vars := body.Variables
+	switch {
+	case strings.Contains(body.Query, "insert_form_data"):
+		for _, in := range vars.Shipments {
+			b.upsert(in)
+		}
+		fmt.Fprintf(w, `{"data":{"insert_form_data":{"affected_rows":%d}}}`, len(vars.Shipments))
+	case strings.Contains(body.Query, "update_form_data_many"):
+		type result struct {
+			AffectedRows int `json:"affected_rows"`
+		}
+		results := []result{}
+		for _, u := range vars.Updates {
+			results = append(results, result{b.update(u)})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"update_form_data_many": results}})
+	case strings.Contains(body.Query, "form_data"):
+		var found []Row
+		for _, r := range b.rows {
+			if r.Schema == vars.SchemaId && !r.Deleted && (vars.Id == "" || r.Id == vars.Id) &&
+				(vars.Ids == nil || contains(vars.Ids, r.Id)) && (vars.CreatedAfter == nil || after(r, *vars.CreatedAfter, vars.AfterId)) {
+				found = append(found, r)
+			}
+		}
+		// order_by: [{created_at: asc}, {id: asc}]
+		sort.SliceStable(found, func(i, j int) bool {
+			return after(found[j], found[i].CreatedAt, found[i].Id)
+		})
+		if vars.Limit != nil && *vars.Limit < len(found) {
+			found = found[:*vars.Limit]
+		}
+		type selected struct {
+			Id        string          `json:"id"`
+			User      string          `json:"user_data_ref_id"`
+			Data      json.RawMessage `json:"data"`
+			CreatedAt time.Time       `json:"created_at"`
+		}
+		res := []selected{}
+		for _, r := range found {
+			res = append(res, selected{r.Id, r.User, r.Data, r.CreatedAt})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"form_data": res}})
+	default:
+		fmt.Fprint(w, `{"data":{"__typename":"query_root"}}`)
+	}
+}
+
+// after tells whether r comes after the row created at createdAt with the given id.
+func after(r Row, createdAt time.Time, id string) bool {
+	if !r.CreatedAt.Equal(createdAt) {
+		return r.CreatedAt.After(createdAt)
+	}
+	return r.Id > id
+}
+
+// upsert inserts in or, like on_conflict with update_columns [data], updates the data of its row.
+func (b *Backend) upsert(in Row) {
+	for i := range b.rows {
+		if b.rows[i].Id == in.Id {
+			b.rows[i].Data = in.Data
+			return
+		}
+	}
+	in.CreatedAt = time.Now()
+	b.rows = append(b.rows, in)
+}
+
+// A dataUpdate is an element of the updates of update_form_data_many,
+// setting the data of the row with the given id if equal to the given data.
+type dataUpdate struct {
+	Where struct {
+		Id struct {
+			Eq string `json:"_eq"`
+		} `json:"id"`
+		Data struct {
+			Eq json.RawMessage `json:"_eq"`
+		} `json:"data"`
+	} `json:"where"`
+	Set struct {
+		Data json.RawMessage `json:"data"`
+	} `json:"_set"`
+}
+
+// update applies u and returns the number of rows affected, 0 or 1.
+func (b *Backend) update(u dataUpdate) int {
+	for i := range b.rows {
+		r := &b.rows[i]
+		if r.Id != u.Where.Id.Eq || r.Deleted {
+			continue
+		}
+		if u.Where.Data.Eq != nil && !jsonEqual(r.Data, u.Where.Data.Eq) {
+			return 0
+		}
+		r.Data = u.Set.Data
+		return 1
+	}
+	return 0
+}
+
+// jsonEqual compares like jsonb equality, regardless of formatting and key order.
+func jsonEqual(a, b json.RawMessage) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func graphqlError(w http.ResponseWriter, msg string) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"message": msg}},
+	})
+}
+
+// An Auth fakes the nhost JWKS, with a key of its own to sign tokens.
+type Auth struct {
+	Kid    string
+	Issuer string // of the tokens, as the iss claim
+	key    *rsa.PrivateKey
+}
+
+// NewAuth returns an Auth with a new key, whose tokens are issued by hasura-auth like those of nhost.
+func NewAuth() *Auth {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return &Auth{Kid: "fake", Issuer: "hasura-auth", key: key}
+}
+
+func (a *Auth) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": a.Kid,
+			"n":   base64.RawURLEncoding.EncodeToString(a.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(a.key.E)).Bytes()),
+		}},
+	})
+}
+
+// Token returns a signed RS256 token of user, valid for ttl, with the given
+// Hasura roles and organization, none if empty, as issued by nhost.
+func (a *Auth) Token(user, organization string, roles []string, ttl time.Duration) string {
+	hasura := map[string]interface{}{
+		"x-hasura-allowed-roles": roles,
+		"x-hasura-default-role":  roles[0],
+		"x-hasura-user-id":       user,
+	}
+	if organization != "" {
+		hasura["x-hasura-organization-id"] = organization
+	}
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": a.Kid})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":                          a.Issuer,
+		"sub":                          user,
+		"iat":                          now.Unix(),
+		"exp":                          now.Add(ttl).Unix(),
+		"https://hasura.io/jwt/claims": hasura,
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
@@ -0,0 +1,236 @@
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/robzan8/taac/vrp"
+)
+
+// A Solver fakes the GraphHopper route optimization API with a greedy heuristic:
+// shipments, by priority, go to the allowed vehicle that can deliver them first,
+// picked up and delivered one at a time, and vehicles return to their start.
+// Shipments that fit in no shift or time window are unassigned. Capacities are
+// ignored beyond the size of single shipments, as a vehicle carries one at a time.
+type Solver struct {
+	// Problems with more distinct locations are refused, like by the free tier. 0 means no limit.
+	MaxLocations int
+	// Of a vehicle type with speed factor 1, in m/s.
+	Speed float64
+	// Road distance over straight line distance.
+	DetourFactor float64
+
+	mu       sync.Mutex
+	problems []vrp.Problem
+}
+
+func NewSolver() *Solver {
+	return &Solver{MaxLocations: 30, Speed: 5, DetourFactor: 1.3}
+}
+
+// Problems returns the problems received, in order.
+func (s *Solver) Problems() []vrp.Problem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]vrp.Problem(nil), s.problems...)
+}
+
+// gh writes an error response in the format of GraphHopper.
+func gh(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": msg})
+}
+
+func (s *Solver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		gh(w, http.StatusMethodNotAllowed, "POST a problem")
+		return
+	}
+	if req.FormValue("key") == "" {
+		gh(w, http.StatusUnauthorized, "Wrong credentials. Register and get a valid API key at https://www.graphhopper.com/developers/")
+		return
+	}
+	var prob vrp.Problem
+	err := json.NewDecoder(req.Body).Decode(&prob)
+	if err != nil {
+		gh(w, http.StatusBadRequest, "Cannot parse problem: "+err.Error())
+		return
+	}
+	s.mu.Lock()
+	s.problems = append(s.problems, prob)
+	s.mu.Unlock()
+	if n := vrp.NumLocations(prob); s.MaxLocations > 0 && n > s.MaxLocations {
+		gh(w, http.StatusBadRequest, fmt.Sprintf("Too many locations: %d, the limit is %d", n, s.MaxLocations))
+		return
+	}
+	sol, err := s.solve(prob)
+	if err != nil {
+		gh(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sol)
+}
+
+type vehicleState struct {
+	v     vrp.Vehicle
+	speed float64
+	cap   int
+	pos   vrp.Address
+	time  int64
+	route vrp.Route
+}
+
+func (s *Solver) solve(prob vrp.Problem) (vrp.Solution, error) {
+	var sol vrp.Solution
+	types := make(map[string]vrp.VehicleType)
+	for _, t := range prob.VehicleTypes {
+		types[t.Id] = t
+	}
+	var states []*vehicleState
+	for _, v := range prob.Vehicles {
+		t, ok := types[v.Type]
+		if !ok {
+			return sol, fmt.Errorf("Vehicle %s has unknown type %q", v.Id, v.Type)
+		}
+		speed := s.Speed
+		if t.SpeedFactor > 0 {
+			speed *= t.SpeedFactor
+		}
+		states = append(states, &vehicleState{
+			v: v, speed: speed, cap: t.Capacity[0], pos: v.StartAddress, time: v.EarliestStart,
+			route: vrp.Route{VehicleId: v.Id, Activities: []vrp.Activity{{
+				Type:    vrp.ActivityTypeStart,
+				Address: v.StartAddress,
+				EndTime: v.EarliestStart,
+			}}},
+		})
+	}
+
+	ships := append([]vrp.Shipment(nil), prob.Shipments...)
+	sort.SliceStable(ships, func(i, j int) bool {
+		return priority(ships[i]) < priority(ships[j])
+	})
+	sol.Solution.Unassigned.Shipments = []string{}
+	for _, ship := range ships {
+		var best *vehicleState
+		var bestEnd int64
+		for _, st := range states {
+			end, ok := s.fits(st, ship)
+			if ok && (best == nil || end < bestEnd) {
+				best, bestEnd = st, end
+			}
+		}
+		if best == nil {
+			sol.Solution.Unassigned.Shipments = append(sol.Solution.Unassigned.Shipments, ship.Id)
+			continue
+		}
+		s.visit(best, vrp.ActivityTypePickup, ship.Id, ship.Pickup)
+		s.visit(best, vrp.ActivityTypeDeliver, ship.Id, ship.Delivery)
+	}
+
+	sol.Solution.Routes = []vrp.Route{}
+	for _, st := range states {
+		if len(st.route.Activities) == 1 {
+			continue // unused
+		}
+		dist := s.distance(st.pos, st.v.StartAddress)
+		st.route.Distance += int64(dist)
+		arr := st.time + int64(dist/st.speed)
+		st.route.Activities = append(st.route.Activities, vrp.Activity{
+			Type:        vrp.ActivityTypeEnd,
+			Address:     st.v.StartAddress,
+			ArrivalTime: arr,
+		})
+		sol.Solution.Routes = append(sol.Solution.Routes, st.route)
+	}
+	return sol, nil
+}
+
+// GraphHopper priorities go from 1, the highest, to 10, 2 being the default.
+func priority(s vrp.Shipment) int {
+	if s.Priority == 0 {
+		return 2
+	}
+	return s.Priority
+}
+
+// fits reports whether st can serve ship next, and when it would be done with it.
+func (s *Solver) fits(st *vehicleState, ship vrp.Shipment) (int64, bool) {
+	if ship.Size[0] > st.cap {
+		return 0, false
+	}
+	if len(ship.AllowedVehicles) > 0 {
+		allowed := false
+		for _, id := range ship.AllowedVehicles {
+			allowed = allowed || id == st.v.Id
+		}
+		if !allowed {
+			return 0, false
+		}
+	}
+	t := st.time + int64(s.distance(st.pos, ship.Pickup.Address)/st.speed)
+	t, ok := arrive(t, ship.Pickup.TimeWindows)
+	if !ok {
+		return 0, false
+	}
+	t += ship.Pickup.PrepTime
+	t += int64(s.distance(ship.Pickup.Address, ship.Delivery.Address) / st.speed)
+	t, ok = arrive(t, ship.Delivery.TimeWindows)
+	if !ok {
+		return 0, false
+	}
+	t += ship.Delivery.PrepTime
+	back := t + int64(s.distance(ship.Delivery.Address, st.v.StartAddress)/st.speed)
+	if st.v.LatestEnd != 0 && back > st.v.LatestEnd {
+		return 0, false
+	}
+	return t, true
+}
+
+// arrive returns when the service can start, arriving at t, waiting for the first window if needed.
+func arrive(t int64, windows []vrp.TimeWindow) (int64, bool) {
+	if len(windows) == 0 {
+		return t, true
+	}
+	for _, w := range windows {
+		if t <= w.Latest {
+			if t < w.Earliest {
+				t = w.Earliest
+			}
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+func (s *Solver) visit(st *vehicleState, typ, shipId string, d vrp.Delivery) {
+	dist := s.distance(st.pos, d.Address)
+	arr := st.time + int64(dist/st.speed)
+	start, _ := arrive(arr, d.TimeWindows)
+	st.route.Distance += int64(dist)
+	st.route.Activities = append(st.route.Activities, vrp.Activity{
+		Type:        typ,
+		ShipmentId:  shipId,
+		Address:     d.Address,
+		ArrivalTime: arr,
+		EndTime:     start + d.PrepTime,
+	})
+	st.pos = d.Address
+	st.time = start + d.PrepTime
+}
+
+// distance estimates the road distance between a and b, in meters.
+func (s *Solver) distance(a, b vrp.Address) float64 {
+	const earthRadius = 6371000
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat, dLon := lat2-lat1, (b.Lon-a.Lon)*math.Pi/180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h)) * s.DetourFactor
+}
@@ -0,0 +1,168 @@
+// Package geocode converts addresses to coordinates with the Google Geocoding API,
+// or a compatible one, caching the results.
+package geocode
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// A Location is a pair of coordinates, in degrees.
+type Location struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lng"`
+}
+
+// Config configures a Client.
+type Config struct {
+	Url       string        `yaml:"url"`
+	Key       string        `yaml:"key"`
+	CacheSize int           `yaml:"cache_size"`
+	Timeout   time.Duration `yaml:"timeout"`
+}
+
+// DefaultConfig is the configuration of the Google API, without the key.
+func DefaultConfig() Config {
+	return Config{
+		Url:       "https://maps.googleapis.com/maps/api/geocode/json",
+		CacheSize: 5000,
+		Timeout:   10 * time.Second,
+	}
+}
+
+// A Client geocodes addresses with the API configured in Config. It is safe for concurrent use.
+type Client struct {
+	Config     Config
+	HTTPClient *http.Client
+
+	// If set, OnLookup is called with the outcome of each cache lookup,
+	// OnStore with the size of the cache after each store and
+	// OnCall after each call to the API, e.g. for metrics.
+	OnLookup func(hit bool)
+	OnStore  func(cacheSize int)
+	OnCall   func(start time.Time, err error)
+
+	mu    sync.Mutex
+	cache map[string]Location
+}
+
+// NewClient returns a Client for the API configured in conf, using http.DefaultClient,
+// with an empty cache.
+func NewClient(conf Config) *Client {
+	return &Client{
+		Config:     conf,
+		HTTPClient: http.DefaultClient,
+		cache:      make(map[string]Location),
+	}
+}
+
+func (c *Client) load(addr string) Location {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.cache[addr]
+}
+
+// Store adds the location of addr to the cache. When the cache is full, it is emptied first.
+func (c *Client) Store(addr string, loc Location) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.cache) < c.Config.CacheSize {
+		c.cache[addr] = loc
+	} else {
+		c.cache = map[string]Location{addr: loc}
+	}
+	if c.OnStore != nil {
+		c.OnStore(len(c.cache))
+	}
+}
+
+// Cached returns a copy of the cache, e.g. to save it.
+func (c *Client) Cached() map[string]Location {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached := make(map[string]Location, len(c.cache))
+	for addr, loc := range c.cache {
+		cached[addr] = loc
+	}
+	return cached
+}
+
+// Lookup returns the location of addr if it is in the cache, without calling the API.
+func (c *Client) Lookup(addr string) (loc Location, ok bool) {
+	loc = c.load(addr)
+	return loc, loc != (Location{})
+}
+
+// Geocode returns the coordinates of addr, from the cache if possible.
+func (c *Client) Geocode(ctx context.Context, addr string) (lat, lon float64, err error) {
+	loc := c.load(addr)
+	if c.OnLookup != nil {
+		c.OnLookup(loc != (Location{}))
+	}
+	if loc != (Location{}) {
+		return loc.Lat, loc.Lon, nil
+	}
+
+	loc, err = c.geocodeApi(ctx, addr)
+	if err != nil {
+		return
+	}
+	c.Store(addr, loc)
+	return loc.Lat, loc.Lon, nil
+}
+
+func (c *Client) geocodeApi(ctx context.Context, addr string) (loc Location, err error) {
+	if c.OnCall != nil {
+		defer func(start time.Time) { c.OnCall(start, err) }(time.Now())
+	}
+
+	queryUrl := fmt.Sprintf("%s?address=%s&key=%s", c.Config.Url, url.QueryEscape(addr), c.Config.Key)
+	ctx, cancel := context.WithTimeout(ctx, c.Config.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, queryUrl, nil)
+	if err != nil {
+		return
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("Geocode query responded with status %d", resp.StatusCode)
+		return
+	}
+
+	var res geocodingResult
+	dec := json.NewDecoder(resp.Body)
+	err = dec.Decode(&res)
+	if err != nil {
+		return
+	}
+	if res.ErrorMsg != "" {
+		err = fmt.Errorf("Error geocoding address %q: %s", addr, res.ErrorMsg)
+		return
+	}
+	if len(res.Results) == 0 {
+		err = fmt.Errorf("No geocode results for address %q", addr)
+		return
+	}
+	return res.Results[0].Geometry.Location, nil
+}
+
+type geocodingResult struct {
+	ErrorMsg string `json:"error_message"`
+	Results  []struct {
+		Geometry struct {
+			Location Location `json:"location"`
+		} `json:"geometry"`
+	} `json:"results"`
+}
@@ -3,3 +3,7 @@ module github.com/robzan8/taac
 go 1.17
 
 // +heroku goVersion go1.17
+
+require github.com/mattn/go-sqlite3 v1.14.16
+
+require gopkg.in/yaml.v3 v3.0.1
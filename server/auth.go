@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The nhost/Hasura JWT claims we care about.
+type tokenClaims struct {
+	Iss    string          `json:"iss"`
+	Exp    int64           `json:"exp"`
+	Nbf    int64           `json:"nbf"`
+	Hasura json.RawMessage `json:"https://hasura.io/jwt/claims"`
+}
+
+type hasuraClaims struct {
+	AllowedRoles []string `json:"x-hasura-allowed-roles"`
+	DefaultRole  string   `json:"x-hasura-default-role"`
+	UserId       string   `json:"x-hasura-user-id"`
+	// Optional custom claim, for users sharing their riders and shipments.
+	OrganizationId string `json:"x-hasura-organization-id"`
+}
+
+// organization identifies the riders and shipments the user works on:
+// their organization if they have one, their own otherwise.
+func (c hasuraClaims) organization() string {
+	if c.OrganizationId != "" {
+		return c.OrganizationId
+	}
+	return "user:" + c.UserId
+}
+
+// hasRole tells whether one of the allowed roles of the user is in roles.
+func (c hasuraClaims) hasRole(roles []string) bool {
+	for _, role := range c.AllowedRoles {
+		for _, r := range roles {
+			if role == r {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bearerToken extracts the token from the Authorization header of req.
+func bearerToken(req *http.Request) (string, error) {
+	auth := req.Header.Get("Authorization")
+	if auth == "" {
+		return "", errors.New("No Authorization header provided")
+	}
+	const prefix = "Bearer "
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", errors.New("Authorization header must be of the form \"Bearer <token>\"")
+	}
+	return strings.TrimSpace(auth[len(prefix):]), nil
+}
+
+// verifyToken checks the signature of an RS256 JWT against the configured JWKS,
+// its expiry, its issuer if conf.Auth.Issuer is set, and that one of its allowed
+// roles is in conf.Auth.Roles.
+func verifyToken(ctx context.Context, token string) (hasuraClaims, error) {
+	var hc hasuraClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return hc, errors.New("Malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return hc, err
+	}
+	if header.Alg != "RS256" {
+		return hc, fmt.Errorf("Unsupported token algorithm %q", header.Alg)
+	}
+	key, err := jwksKey(ctx, header.Kid)
+	if err != nil {
+		return hc, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return hc, errors.New("Malformed token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig)
+	if err != nil {
+		return hc, errors.New("Invalid token signature")
+	}
+
+	var claims tokenClaims
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return hc, err
+	}
+	now := time.Now().Unix()
+	if claims.Exp == 0 || now >= claims.Exp {
+		return hc, errors.New("Token expired")
+	}
+	if claims.Nbf != 0 && now < claims.Nbf {
+		return hc, errors.New("Token not yet valid")
+	}
+	if conf.Auth.Issuer != "" && claims.Iss != conf.Auth.Issuer {
+		return hc, fmt.Errorf("Token issued by %q", claims.Iss)
+	}
+	hc, err = parseHasuraClaims(claims.Hasura)
+	if err != nil {
+		return hc, err
+	}
+	if !hc.hasRole(conf.Auth.Roles) {
+		return hc, errors.New("Token has no allowed role")
+	}
+	return hc, nil
+}
+
+func decodeSegment(seg string, dest interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errors.New("Malformed token")
+	}
+	err = json.Unmarshal(b, dest)
+	if err != nil {
+		return errors.New("Malformed token")
+	}
+	return nil
+}
+
+// Hasura accepts the claims both as a JSON object and as a stringified one.
+func parseHasuraClaims(raw json.RawMessage) (hasuraClaims, error) {
+	var hc hasuraClaims
+	if len(raw) == 0 {
+		return hc, errors.New("Token has no Hasura claims")
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		raw = json.RawMessage(s)
+	}
+	err := json.Unmarshal(raw, &hc)
+	if err != nil {
+		return hc, errors.New("Malformed Hasura claims")
+	}
+	return hc, nil
+}
+
+var (
+	jwksKeys    = make(map[string]*rsa.PublicKey)
+	jwksFetched time.Time
+	jwksMu      sync.Mutex
+)
+
+// Unknown key ids trigger a refetch of the key set, but not more often than this.
+const jwksRefreshInterval = time.Minute
+
+func jwksKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	jwksMu.Lock()
+	defer jwksMu.Unlock()
+
+	key := jwksKeys[kid]
+	if key != nil {
+		return key, nil
+	}
+	if time.Since(jwksFetched) < jwksRefreshInterval {
+		return nil, fmt.Errorf("Unknown token key %q", kid)
+	}
+	keys, err := fetchJwks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	jwksKeys = keys
+	jwksFetched = time.Now()
+	key = jwksKeys[kid]
+	if key == nil {
+		return nil, fmt.Errorf("Unknown token key %q", kid)
+	}
+	return key, nil
+}
+
+func fetchJwks(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, conf.Auth.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, conf.Auth.JwksUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS query responded with status %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&set)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed JWKS key %q", k.Kid)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed JWKS key %q", k.Kid)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
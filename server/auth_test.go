@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robzan8/taac/fake"
+)
+
+func TestVerifyToken(t *testing.T) {
+	s := startFakes(t)
+	roles := []string{"user"}
+	otherKey := fake.NewAuth() // same kid, different key
+	unknownKid := *s.Auth
+	unknownKid.Kid = "rotated"
+	otherIssuer := *s.Auth
+	otherIssuer.Issuer = "someone-else"
+
+	for _, test := range []struct {
+		name, token, wantErr string
+	}{
+		{"valid", s.Auth.Token(testUser, "acme", roles, time.Hour), ""},
+		{"bad signature", otherKey.Token(testUser, "acme", roles, time.Hour), "Invalid token signature"},
+		{"tampered", tamper(s.Auth.Token(testUser, "acme", roles, time.Hour)), "Invalid token signature"},
+		{"expired", s.Auth.Token(testUser, "acme", roles, -time.Minute), "Token expired"},
+		{"unknown kid", unknownKid.Token(testUser, "acme", roles, time.Hour), `Unknown token key "rotated"`},
+		{"wrong issuer", otherIssuer.Token(testUser, "acme", roles, time.Hour), `Token issued by "someone-else"`},
+		{"no allowed role", s.Auth.Token(testUser, "acme", []string{"anonymous"}, time.Hour), "Token has no allowed role"},
+		{"malformed", "not.a-token", "Malformed token"},
+	} {
+		claims, err := verifyToken(context.Background(), test.token)
+		switch {
+		case test.wantErr == "" && err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		case test.wantErr == "" && claims.organization() != "acme":
+			t.Errorf("%s: got claims %+v", test.name, claims)
+		case test.wantErr != "" && (err == nil || err.Error() != test.wantErr):
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+// tamper changes the organization in the claims of token, keeping its signature.
+func tamper(token string) string {
+	parts := strings.Split(token, ".")
+	claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	claims = []byte(strings.Replace(string(claims), `"acme"`, `"evil"`, 1))
+	parts[1] = base64.RawURLEncoding.EncodeToString(claims)
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/robzan8/taac/vrp"
+)
+
+// solutionSummary is what the comparison needs to know about a /solution.csv result.
+type solutionSummary struct {
+	Label      string                 `json:"label"`
+	Riders     map[string]*riderStats `json:"riders"`
+	Unassigned int                    `json:"unassigned"`
+
+	assignments map[int]assignment // by row of the shipment
+	shipments   map[int]string     // notes and delivery address, by row
+}
+
+type riderStats struct {
+	DistanceKm  float64 `json:"distance_km"`
+	DurationMin int64   `json:"duration_min"`
+	Stops       int     `json:"stops"`
+}
+
+type assignment struct {
+	Rider string `json:"rider"`
+	Slot  string `json:"slot"` // hour of the delivery, e.g. "09:00-10:00"
+}
+
+// A shipmentMove is a shipment that has a different rider or time slot in the two solutions.
+type shipmentMove struct {
+	Row      int        `json:"row"` // in the solutions, as in the shipments file
+	Shipment string     `json:"shipment"`
+	A        assignment `json:"a"`
+	B        assignment `json:"b"`
+}
+
+type riderComparison struct {
+	Rider string      `json:"rider"`
+	A     *riderStats `json:"a"`
+	B     *riderStats `json:"b"`
+}
+
+type comparison struct {
+	A      *solutionSummary  `json:"a"`
+	B      *solutionSummary  `json:"b"`
+	Riders []riderComparison `json:"riders"`
+	Moved  []shipmentMove    `json:"moved"`
+}
+
+// summarizeSolution reads a /solution.csv result. Distances come from sol, the solver
+// response, when known, otherwise they are estimated from the coordinates of the stops
+// in sol or in the geocoding cache: the geocoding API is never called, and legs to
+// addresses that were never geocoded are left out.
+func summarizeSolution(label string, resultCsv io.Reader, sol *vrp.Solution) (*solutionSummary, error) {
+	sum := &solutionSummary{
+		Label:       label,
+		Riders:      make(map[string]*riderStats),
+		assignments: make(map[int]assignment),
+		shipments:   make(map[int]string),
+	}
+	r := csv.NewReader(resultCsv)
+	_, err := r.Read() // read away the header
+	if err == io.EOF {
+		return nil, fmt.Errorf("Empty solution %s", label)
+	}
+	if err != nil {
+		return nil, err
+	}
+	type stop struct {
+		t    int64
+		addr string
+	}
+	stops := make(map[string][]stop)
+	for row := 1; true; row++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) != 7 {
+			return nil, fmt.Errorf("Line in solution %s must have 7 entries", label)
+		}
+		rider, notes, pickupAddr, deliveryAddr, day := rec[0], rec[1], rec[2], rec[3], rec[4]
+		sum.shipments[row] = notes + " (" + deliveryAddr + ")"
+		if rider == "" {
+			sum.Unassigned++
+			sum.assignments[row] = assignment{}
+			continue
+		}
+		pickupTime, err := unixTime(day, rec[5])
+		if err != nil {
+			return nil, err
+		}
+		deliveryTime, err := unixTime(day, rec[6])
+		if err != nil {
+			return nil, err
+		}
+		stops[rider] = append(stops[rider], stop{pickupTime, pickupAddr}, stop{deliveryTime, deliveryAddr})
+		slotStart := time.Unix(deliveryTime, 0).In(timeZone).Truncate(time.Hour)
+		sum.assignments[row] = assignment{
+			Rider: rider,
+			Slot:  slotStart.Format("15:04") + "-" + slotStart.Add(time.Hour).Format("15:04"),
+		}
+	}
+
+	routeKm := make(map[string]float64)
+	located := make(map[string]vrp.Address)
+	if sol != nil {
+		for _, route := range sol.Solution.Routes {
+			routeKm[route.VehicleId] = float64(route.Distance) / 1000
+			for _, act := range route.Activities {
+				located[act.Address.Str] = act.Address
+			}
+		}
+	}
+	locate := func(addr string) (lat, lon float64, ok bool) {
+		if a, ok := located[addr]; ok {
+			return a.Lat, a.Lon, true
+		}
+		loc, ok := geocoder.Lookup(addr)
+		return loc.Lat, loc.Lon, ok
+	}
+
+	for rider, st := range stops {
+		sort.SliceStable(st, func(i, j int) bool { return st[i].t < st[j].t })
+		stats := &riderStats{
+			Stops:       len(st),
+			DurationMin: (st[len(st)-1].t - st[0].t) / 60,
+			DistanceKm:  routeKm[rider],
+		}
+		for i := 1; i < len(st) && stats.DistanceKm == 0; i++ {
+			lat1, lon1, ok1 := locate(st[i-1].addr)
+			lat2, lon2, ok2 := locate(st[i].addr)
+			if ok1 && ok2 {
+				stats.DistanceKm += distanceKm(lat1, lon1, lat2, lon2) * conf.Tracking.DetourFactor
+			}
+		}
+		sum.Riders[rider] = stats
+	}
+	return sum, nil
+}
+
+func compareSolutions(a, b *solutionSummary) comparison {
+	c := comparison{A: a, B: b}
+	riders := make(map[string]bool)
+	for r := range a.Riders {
+		riders[r] = true
+	}
+	for r := range b.Riders {
+		riders[r] = true
+	}
+	for r := range riders {
+		c.Riders = append(c.Riders, riderComparison{r, a.Riders[r], b.Riders[r]})
+	}
+	sort.Slice(c.Riders, func(i, j int) bool { return c.Riders[i].Rider < c.Riders[j].Rider })
+
+	// Rows are only the same shipment if the solutions are of the same shipments file.
+	for row, asgA := range a.assignments {
+		asgB, ok := b.assignments[row]
+		if ok && a.shipments[row] == b.shipments[row] && asgA != asgB {
+			c.Moved = append(c.Moved, shipmentMove{row, a.shipments[row], asgA, asgB})
+		}
+	}
+	sort.Slice(c.Moved, func(i, j int) bool { return c.Moved[i].Row < c.Moved[j].Row })
+	return c
+}
+
+// summaryFromRequest summarizes the history run whose id is in the form value name
+// or, if there is none, the solution file uploaded as name.
+func summaryFromRequest(req *http.Request, name string) (*solutionSummary, error) {
+	if idStr := req.FormValue(name); idStr != "" {
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be the id of a run", name)
+		}
+		run, err := loadRun(id)
+		if err != nil {
+			return nil, err
+		}
+		if run == nil || run.Error != "" {
+			return nil, fmt.Errorf("Run %d not found or failed", id)
+		}
+		var sol *vrp.Solution
+		if len(run.SolverResponse) > 0 {
+			sol = new(vrp.Solution)
+			err = json.Unmarshal(run.SolverResponse, sol)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return summarizeSolution(fmt.Sprintf("run %d", id), bytes.NewReader([]byte(run.ResultCsv)), sol)
+	}
+	f, header, err := req.FormFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("Provide a run id or a solution file as %s", name)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return summarizeSolution(header.Filename, bytes.NewReader(data), nil)
+}
+
+// compareEndpoint compares solutions a and b, as JSON for /compare.json or HTML.
+// Without a and b, the HTML page shows a form to choose them.
+func compareEndpoint(w http.ResponseWriter, req *http.Request) {
+	if !historyAuth(w, req) {
+		return
+	}
+	asJson := req.URL.Path == "/compare.json"
+	if !asJson && req.Method == http.MethodGet && req.FormValue("a") == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		compareTmpl.Execute(w, nil)
+		return
+	}
+
+	var err error // beware of shadowing
+	defer func() {
+		if err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			fmt.Fprintf(w, "%s", err)
+		}
+	}()
+	a, err := summaryFromRequest(req, "a")
+	if err != nil {
+		return
+	}
+	b, err := summaryFromRequest(req, "b")
+	if err != nil {
+		return
+	}
+	c := compareSolutions(a, b)
+	if asJson {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(c)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = compareTmpl.Execute(w, c)
+}
+
+var compareTmpl = template.Must(template.New("compare").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="UTF-8">
+<title>taac! confronto</title>
+` + historyStyle + `
+</head>
+
+<body>
+<h1>Taac<span>!</span> confronto</h1>
+{{define "stats"}}{{if .}}<td>{{printf "%.1f" .DistanceKm}}</td><td>{{.DurationMin}}</td><td>{{.Stops}}</td>{{else}}<td>-</td><td>-</td><td>-</td>{{end}}{{end}}
+{{define "asg"}}{{if .Rider}}{{.Rider}}, {{.Slot}}{{else}}non assegnata{{end}}{{end}}
+{{if .}}
+<table>
+	<tr><th></th><th colspan="3">A: {{.A.Label}}</th><th colspan="3">B: {{.B.Label}}</th></tr>
+	<tr><th>rider</th><th>km</th><th>minuti</th><th>tappe</th><th>km</th><th>minuti</th><th>tappe</th></tr>
+	{{range .Riders}}<tr><td>{{.Rider}}</td>{{template "stats" .A}}{{template "stats" .B}}</tr>{{end}}
+	<tr><td>non assegnate</td><td colspan="3">{{.A.Unassigned}}</td><td colspan="3">{{.B.Unassigned}}</td></tr>
+</table>
+<h2>Consegne spostate</h2>
+<table>
+	<tr><th>riga</th><th>consegna</th><th>A</th><th>B</th></tr>
+	{{range .Moved}}<tr><td>{{.Row}}</td><td>{{.Shipment}}</td><td>{{template "asg" .A}}</td><td>{{template "asg" .B}}</td></tr>{{end}}
+</table>
+{{else}}
+<p>Scegli due ottimizzazioni dallo <a href="/history.html">storico</a> o carica due file solution.csv.</p>
+<form enctype="multipart/form-data" action="/compare.html" method="post">
+	<span>Run A (numero):</span>
+	<input type="number" name="a">
+	<span>oppure file A:</span>
+	<input type="file" accept=".csv" name="a">
+	<span>Run B (numero):</span>
+	<input type="number" name="b">
+	<span>oppure file B:</span>
+	<input type="file" accept=".csv" name="b">
+	<span></span>
+	<input type="submit" value="Confronta">
+</form>
+{{end}}
+</body>
+
+</html>
+`))
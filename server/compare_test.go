@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/robzan8/taac/geocode"
+)
+
+// Rows 1 and 2 are the same delivery, twice: both swap rider.
+const (
+	solutionA = `rider,destinatario/contatti/note,indirizzo di ritiro,indirizzo di consegna,giorno,orario di ritiro,orario di consegna
+Anna,Mario,Via Roma 1 Milano,Via Po 2 Milano,2024-03-04,09:00,09:20
+Bob,Mario,Via Roma 1 Milano,Via Po 2 Milano,2024-03-04,09:00,09:20
+Anna,Luca,Via Roma 1 Milano,Corso Como 5 Milano,2024-03-04,09:30,09:50
+`
+	solutionB = `rider,destinatario/contatti/note,indirizzo di ritiro,indirizzo di consegna,giorno,orario di ritiro,orario di consegna
+Bob,Mario,Via Roma 1 Milano,Via Po 2 Milano,2024-03-04,09:00,09:20
+Anna,Mario,Via Roma 1 Milano,Via Po 2 Milano,2024-03-04,09:00,09:20
+Anna,Luca,Via Roma 1 Milano,Corso Como 5 Milano,2024-03-04,09:30,09:50
+`
+)
+
+func TestCompareSolutions(t *testing.T) {
+	s := startFakes(t)
+	geocoder.Store("Via Roma 1 Milano", geocode.Location{Lat: 45.465, Lon: 9.180})
+	geocoder.Store("Via Po 2 Milano", geocode.Location{Lat: 45.470, Lon: 9.200})
+	a, err := summarizeSolution("a", strings.NewReader(solutionA), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := summarizeSolution("b", strings.NewReader(solutionB), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := compareSolutions(a, b)
+	if len(c.Moved) != 2 || c.Moved[0].Row != 1 || c.Moved[1].Row != 2 ||
+		c.Moved[0].A.Rider != "Anna" || c.Moved[0].B.Rider != "Bob" {
+		t.Errorf("moved: %+v, want rows 1 and 2 swapped", c.Moved)
+	}
+	if km := a.Riders["Bob"].DistanceKm; km < 1 || km > 3 {
+		t.Errorf("Bob rides %.1f km, want about 2", km)
+	}
+	if n := s.Geocoder.Requests(); n > 0 {
+		t.Errorf("%d geocoding requests, want none", n)
+	}
+}
@@ -1,21 +1,21 @@
 package main
 
 import (
-	"encoding/csv"
+	"bytes"
+	"encoding/json"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"net/http"
-	"sort"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/robzan8/taac/shipments"
+	"github.com/robzan8/taac/vrp"
 )
 
 func csvEndpoint(w http.ResponseWriter, req *http.Request) {
-	setAllowOrigins(w.Header())
-
 	switch req.Method {
-	case http.MethodOptions:
-		// OK
 	case http.MethodGet:
 		fmt.Fprintln(w, "You should POST your shipments file here")
 	case http.MethodPost:
@@ -27,17 +27,29 @@ func csvEndpoint(w http.ResponseWriter, req *http.Request) {
 }
 
 func csvPost(w http.ResponseWriter, req *http.Request) {
-	if req.FormValue("password") != password {
+	if req.FormValue("password") != conf.Server.Password {
 		w.WriteHeader(http.StatusUnauthorized)
 		fmt.Fprint(w, "Wrong password")
 		return
 	}
 
+	// Every run is saved to the history, failed ones too.
+	start := time.Now()
+	run := &historyRun{
+		CreatedAt: start.In(timeZone).Format(time.RFC3339),
+		Operator:  req.FormValue("operator"),
+		Params:    runParamsFromRequest(req),
+	}
 	var err error // beware of shadowing
 	defer func() {
 		if err != nil {
-			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.WriteHeader(errorStatus(err))
 			fmt.Fprintf(w, "%s", err)
+			run.Error = err.Error()
+		}
+		run.DurationMs = time.Since(start).Milliseconds()
+		if err := saveRun(run); err != nil {
+			logReq(req, "error", "Saving run to history: "+err.Error())
 		}
 	}()
 
@@ -56,128 +68,90 @@ func csvPost(w http.ResponseWriter, req *http.Request) {
 		err = fmt.Errorf("parcelsPerBike must be an integer between 1 and 100")
 		return
 	}
-	var startAddr Address
-	startAddr.Str = req.FormValue("startAddress")
-	startAddr.Lat, startAddr.Lon, err = GeocodeAddress(startAddr.Str)
+	var riders []shipments.Rider
+	for _, riderName := range strings.Split(ridersList, ",") {
+		var r shipments.Rider
+		r.Id = strings.TrimSpace(riderName)
+		r.Data.Name = r.Id
+		r.Data.VehicleTypeId = conf.VehicleTypes[0].Id
+		r.Data.StartAddress = req.FormValue("startAddress")
+		r.Data.EarliestStart = req.FormValue("startTime")
+		r.Data.LatestEnd = req.FormValue("endTime")
+		riders = append(riders, r)
+	}
+
+	input, err := shipmentsInput(req)
 	if err != nil {
 		return
 	}
-	startTime, err := unixTime(req.FormValue("startTime"))
+	run.InputCsv = string(input)
+	shipSize := conf.VehicleTypes[0].Capacity[0] / parcelsPerBike
+	shipData, err := shipments.ReadCsv(bytes.NewReader(input), shipSize)
 	if err != nil {
 		return
 	}
-	endTime, err := unixTime(req.FormValue("endTime"))
+	problem, err := planner.Problem(req.Context(), riders, shipData, schedDate)
 	if err != nil {
 		return
 	}
-	var vehicles []Vehicle
-	for _, riderName := range strings.Split(ridersList, ",") {
-		vehicles = append(vehicles, Vehicle{
-			Id:            strings.TrimSpace(riderName),
-			Type:          CargoBikeId,
-			StartAddress:  startAddr,
-			EarliestStart: startTime,
-			LatestEnd:     endTime,
-		})
-	}
-
-	f, _, err := req.FormFile("shipments")
+	run.Geocodes = problemGeocodes(problem)
+	run.SolverRequest, err = json.Marshal(problem)
 	if err != nil {
 		return
 	}
-	defer f.Close()
-	shipSize := CargoBikeType.Capacity[0] / parcelsPerBike
-	shipData, err := readCsvShipments(f, shipSize)
+	solution, err := planner.Solve(req.Context(), problem, shipData, schedDate)
 	if err != nil {
 		return
 	}
-	var ships []Shipment
-	for _, d := range shipData {
-		var s Shipment
-		s, err = dataToShipment(d)
-		if err != nil {
-			return
-		}
-		ships = append(ships, s)
+	run.SolverResponse, err = json.Marshal(solution)
+	if err != nil {
+		return
 	}
 
-	problem := CreateProblem(vehicles, ships)
-	solution, err := Solve(problem)
+	var out bytes.Buffer
+	err = shipments.WriteCsv(&out, shipData)
 	if err != nil {
 		return
 	}
-
-	writeSolutionIntoShipments(shipData, solution, schedDate)
-	sort.SliceStable(shipData, func(i, j int) bool {
-		return shipData[i].Data.DeliveryTime < shipData[j].Data.DeliveryTime
-	})
-	sort.SliceStable(shipData, func(i, j int) bool {
-		// We want unassigned shipments at the end.
-		if shipData[i].Data.RiderName == "" {
-			return false
-		}
-		if shipData[j].Data.RiderName == "" {
-			return true
-		}
-		return shipData[i].Data.RiderName < shipData[j].Data.RiderName
-	})
-
+	run.ResultCsv = out.String()
 	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
-	err = writeCsvShipments(w, shipData)
+	w.Write(out.Bytes())
 }
 
-func readCsvShipments(in io.Reader, shipSize int) ([]shipmentData, error) {
-	var ships []shipmentData
-	r := csv.NewReader(in)
-	_, err := r.Read() // read away the header
-	if err == io.EOF {
-		return nil, fmt.Errorf("Empty shipments file")
+// problemGeocodes collects the addresses of prob with their coordinates.
+func problemGeocodes(prob vrp.Problem) map[string]vrp.Address {
+	geocodes := make(map[string]vrp.Address)
+	for _, v := range prob.Vehicles {
+		geocodes[v.StartAddress.Str] = v.StartAddress
 	}
-	if err != nil {
-		return nil, err
+	for _, s := range prob.Shipments {
+		geocodes[s.Pickup.Address.Str] = s.Pickup.Address
+		geocodes[s.Delivery.Address.Str] = s.Delivery.Address
 	}
-	for i := 1; true; i++ {
-		rec, err := r.Read()
-		if err == io.EOF {
-			break
+	return geocodes
+}
+
+// shipmentsInput reads the uploaded shipments file or,
+// to run a past optimization again, the one of the run in historyId.
+func shipmentsInput(req *http.Request) ([]byte, error) {
+	if idStr := req.FormValue("historyId"); idStr != "" {
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("historyId must be an integer")
 		}
+		run, err := loadRun(id)
 		if err != nil {
 			return nil, err
 		}
-
-		if len(rec) != 3 {
-			return nil, fmt.Errorf("Line in shipments csv must have 3 entries")
+		if run == nil {
+			return nil, fmt.Errorf("Run %d not found", id)
 		}
-		var s shipmentData
-		s.Id = strconv.Itoa(i)
-		s.Data.Size = shipSize
-		s.Data.PickupAddress = rec[1]
-		s.Data.DeliveryAddress = rec[2]
-		s.Data.Notes = rec[0]
-		ships = append(ships, s)
-	}
-	return ships, nil
-}
-
-func writeCsvShipments(out io.Writer, ships []shipmentData) error {
-	w := csv.NewWriter(out)
-	err := w.Write([]string{
-		"rider", "destinatario/contatti/note", "indirizzo di ritiro",
-		"indirizzo di consegna", "giorno", "orario di ritiro", "orario di consegna",
-	})
+		return []byte(run.InputCsv), nil
+	}
+	f, _, err := req.FormFile("shipments")
 	if err != nil {
-		return err
-	}
-	for _, s := range ships {
-		d := s.Data
-		err = w.Write([]string{
-			d.RiderName, d.Notes, d.PickupAddress, d.DeliveryAddress,
-			d.ShipmentDay, d.PickupTime, d.DeliveryTime,
-		})
-		if err != nil {
-			return err
-		}
+		return nil, err
 	}
-	w.Flush()
-	return w.Error()
+	defer f.Close()
+	return ioutil.ReadAll(f)
 }
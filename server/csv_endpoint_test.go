@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testShipmentsCsv = `note,ritiro,consegna
+Mario,Via Roma 1 Milano,Via Po 2 Milano
+Luca,Via Roma 1 Milano,Corso Como 5 Milano
+Anna,Via Roma 1 Milano,Viale Monza 10 Milano
+`
+
+// csvRequest builds a /solution.csv upload with the given form values and shipments file.
+func csvRequest(t *testing.T, values map[string]string, shipmentsCsv string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range values {
+		mw.WriteField(k, v)
+	}
+	f, err := mw.CreateFormFile("shipments", "shipments.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(shipmentsCsv))
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/solution.csv", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestCsvPost(t *testing.T) {
+	s := startFakes(t)
+	values := map[string]string{
+		"password":       conf.Server.Password,
+		"operator":       "tester",
+		"date":           "2024-03-04",
+		"riders":         "Anna, Bob",
+		"parcelsPerBike": "4",
+		"startAddress":   "Piazza Duomo Milano",
+		"startTime":      "09:00",
+		"endTime":        "17:00",
+	}
+	rec := do(t, s, csvRequest(t, values, testShipmentsCsv))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	out := rec.Body.String()
+	records, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("got %d lines, want a header and 3 shipments:\n%s", len(records), out)
+	}
+	for _, r := range records[1:] {
+		rider, day, pickup, delivery := r[0], r[4], r[5], r[6]
+		if rider != "Anna" && rider != "Bob" {
+			t.Errorf("shipment %q assigned to %q", r[1], rider)
+		}
+		if day != "2024-03-04" || pickup == "" || delivery == "" || delivery < pickup {
+			t.Errorf("shipment %q on %q, picked up at %q and delivered at %q", r[1], day, pickup, delivery)
+		}
+	}
+
+	runs, err := listRuns(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].Operator != "tester" || runs[0].Error != "" {
+		t.Fatalf("history has %+v, want the run of tester", runs)
+	}
+	run, err := loadRun(runs[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.InputCsv != testShipmentsCsv || run.ResultCsv != out || run.Params.Riders != "Anna, Bob" {
+		t.Errorf("history run does not match the request: %+v", run)
+	}
+}
+
+func TestCsvPostSavesFailedRuns(t *testing.T) {
+	s := startFakes(t)
+	values := map[string]string{
+		"password": conf.Server.Password,
+		"date":     "04/03/2024",
+	}
+	rec := do(t, s, csvRequest(t, values, testShipmentsCsv))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusUnprocessableEntity)
+	}
+	runs, err := listRuns(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].Error != rec.Body.String() {
+		t.Fatalf("history has %+v, want the failed run", runs)
+	}
+}
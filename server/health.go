@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	readHeaderTimeout = 10 * time.Second
+	readyCheckTimeout = 5 * time.Second
+)
+
+var (
+	// Set when draining, so that load balancers stop sending requests.
+	shuttingDown int32
+
+	// Notifications and webhook deliveries still running, waited for at shutdown.
+	background       sync.WaitGroup
+	backgroundMu     sync.Mutex
+	backgroundClosed bool // no more background work is accepted
+	// Canceled at shutdown, so that the background work stops waiting to retry.
+	backgroundCtx, stopBackground = context.WithCancel(context.Background())
+)
+
+// goBackground runs f in the background, to be waited for at shutdown.
+// Once the shutdown started, f is not run and goBackground returns false.
+func goBackground(f func()) bool {
+	backgroundMu.Lock()
+	defer backgroundMu.Unlock()
+
+	if backgroundClosed {
+		return false
+	}
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		f()
+	}()
+	return true
+}
+
+// serve listens on port until SIGTERM or SIGINT, then stops accepting connections,
+// waits for the requests in flight and the background work, and flushes the caches.
+func serve(handler http.Handler) {
+	srv := &http.Server{
+		Addr:              ":" + conf.Server.Port,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       conf.Server.ReadTimeout,
+		WriteTimeout:      conf.Server.WriteTimeout,
+		IdleTimeout:       conf.Server.IdleTimeout,
+	}
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+		log.Printf("Received %s, shutting down", <-sig)
+		atomic.StoreInt32(&shuttingDown, 1)
+
+		ctx, cancel := context.WithTimeout(context.Background(), conf.Server.ShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Draining requests: %s", err)
+		}
+		waitBackground(ctx)
+		if err := saveGeocodeCache(); err != nil {
+			log.Printf("Saving geocode cache: %s", err)
+		}
+		historyDb.Close()
+		close(done)
+	}()
+
+	err := srv.ListenAndServe()
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+	log.Printf("Shut down")
+}
+
+// waitBackground stops accepting background work and waits for the running one,
+// or until ctx is done. Webhook deliveries waiting to be retried give up.
+func waitBackground(ctx context.Context) {
+	backgroundMu.Lock()
+	backgroundClosed = true
+	backgroundMu.Unlock()
+	stopBackground()
+
+	finished := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		log.Printf("Background work still running at shutdown")
+	}
+}
+
+// healthzEndpoint tells that the process is alive.
+func healthzEndpoint(w http.ResponseWriter, req *http.Request) {
+	fmt.Fprint(w, "ok")
+}
+
+// readyzEndpoint tells whether the server can serve requests:
+// it checks the dependencies and fails while shutting down.
+func readyzEndpoint(w http.ResponseWriter, req *http.Request) {
+	if atomic.LoadInt32(&shuttingDown) != 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "shutting down")
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), readyCheckTimeout)
+	defer cancel()
+	checks := []struct {
+		name  string
+		check func(context.Context) error
+	}{
+		{"history", historyDb.PingContext},
+		{"jwks", checkJwks},
+		{"graphql", checkGraphql},
+		{"storage", checkStorage},
+	}
+	results := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, check func(context.Context) error) {
+			defer wg.Done()
+			results[i] = check(ctx)
+		}(i, c.check)
+	}
+	wg.Wait()
+
+	var report strings.Builder
+	ready := true
+	for i, c := range checks {
+		if results[i] != nil {
+			ready = false
+			fmt.Fprintf(&report, "%s: %s\n", c.name, results[i])
+		} else {
+			fmt.Fprintf(&report, "%s: ok\n", c.name)
+		}
+	}
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprint(w, report.String())
+}
+
+func checkJwks(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, conf.Auth.JwksUrl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// checkGraphql pings the backend bypassing any cassette, not to fill it with readiness checks.
+func checkGraphql(ctx context.Context) error {
+	c := *backend
+	c.HTTPClient = http.DefaultClient
+	return c.Ping(ctx)
+}
+
+func checkStorage(ctx context.Context) error {
+	_, _, err := podStore.Get(ctx, "readyz/missing")
+	if err != nil && !errors.Is(err, errBlobNotFound) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/robzan8/taac/vrp"
+)
+
+// A historyRun is a /solution.csv optimization, as stored in the history database.
+type historyRun struct {
+	Id             int64                  `json:"id"`
+	CreatedAt      string                 `json:"created_at"`
+	Operator       string                 `json:"operator"`
+	Params         runParams              `json:"params"`
+	InputCsv       string                 `json:"input_csv,omitempty"`
+	Geocodes       map[string]vrp.Address `json:"geocodes,omitempty"`
+	SolverRequest  json.RawMessage        `json:"solver_request,omitempty"`
+	SolverResponse json.RawMessage        `json:"solver_response,omitempty"`
+	ResultCsv      string                 `json:"result_csv,omitempty"`
+	DurationMs     int64                  `json:"duration_ms"`
+	Error          string                 `json:"error,omitempty"`
+}
+
+// runParams are the form values of /solution.csv, except the files.
+type runParams struct {
+	Date           string `json:"date"`
+	Riders         string `json:"riders"`
+	ParcelsPerBike string `json:"parcelsPerBike"`
+	StartAddress   string `json:"startAddress"`
+	StartTime      string `json:"startTime"`
+	EndTime        string `json:"endTime"`
+}
+
+func runParamsFromRequest(req *http.Request) runParams {
+	return runParams{
+		Date:           req.FormValue("date"),
+		Riders:         req.FormValue("riders"),
+		ParcelsPerBike: req.FormValue("parcelsPerBike"),
+		StartAddress:   req.FormValue("startAddress"),
+		StartTime:      req.FormValue("startTime"),
+		EndTime:        req.FormValue("endTime"),
+	}
+}
+
+var historyDb *sql.DB
+
+func openHistory(path string) error {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(1) // sqlite allows a single writer anyway
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS runs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at TEXT NOT NULL,
+		operator TEXT NOT NULL,
+		params TEXT NOT NULL,
+		input_csv TEXT NOT NULL,
+		geocodes TEXT NOT NULL,
+		solver_request TEXT NOT NULL,
+		solver_response TEXT NOT NULL,
+		result_csv TEXT NOT NULL,
+		duration_ms INTEGER NOT NULL,
+		error TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS geocodes (
+		address TEXT PRIMARY KEY,
+		lat REAL NOT NULL,
+		lon REAL NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	historyDb = db
+	return nil
+}
+
+func saveRun(run *historyRun) error {
+	params, err := json.Marshal(run.Params)
+	if err != nil {
+		return err
+	}
+	geocodes, err := json.Marshal(run.Geocodes)
+	if err != nil {
+		return err
+	}
+	res, err := historyDb.Exec(`INSERT INTO runs (created_at, operator, params, input_csv, geocodes,
+		solver_request, solver_response, result_csv, duration_ms, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		run.CreatedAt, run.Operator, string(params), run.InputCsv, string(geocodes),
+		string(run.SolverRequest), string(run.SolverResponse), run.ResultCsv, run.DurationMs, run.Error,
+	)
+	if err != nil {
+		return err
+	}
+	run.Id, err = res.LastInsertId()
+	return err
+}
+
+// listRuns returns the most recent runs, without their bulky fields.
+func listRuns(limit int) ([]historyRun, error) {
+	rows, err := historyDb.Query(`SELECT id, created_at, operator, params, duration_ms, error
+		FROM runs ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var runs []historyRun
+	for rows.Next() {
+		var r historyRun
+		var params string
+		err = rows.Scan(&r.Id, &r.CreatedAt, &r.Operator, &params, &r.DurationMs, &r.Error)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(params), &r.Params)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// loadRun returns nil if there is no run with the given id.
+func loadRun(id int64) (*historyRun, error) {
+	var r historyRun
+	var params, geocodes, solverReq, solverResp string
+	err := historyDb.QueryRow(`SELECT id, created_at, operator, params, input_csv, geocodes,
+		solver_request, solver_response, result_csv, duration_ms, error
+		FROM runs WHERE id = ?`, id).Scan(
+		&r.Id, &r.CreatedAt, &r.Operator, &params, &r.InputCsv, &geocodes,
+		&solverReq, &solverResp, &r.ResultCsv, &r.DurationMs, &r.Error,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(params), &r.Params)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(geocodes), &r.Geocodes)
+	if err != nil {
+		return nil, err
+	}
+	if solverReq != "" {
+		r.SolverRequest = json.RawMessage(solverReq)
+	}
+	if solverResp != "" {
+		r.SolverResponse = json.RawMessage(solverResp)
+	}
+	return &r, nil
+}
+
+// historyAuth checks the PASSWORD with HTTP basic authentication,
+// so that browsers ask for it. The user name is free.
+func historyAuth(w http.ResponseWriter, req *http.Request) bool {
+	_, pass, ok := req.BasicAuth()
+	if !ok || pass != conf.Server.Password {
+		w.Header().Set("WWW-Authenticate", `Basic realm="taac"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Wrong password")
+		return false
+	}
+	return true
+}
+
+// runFromRequest loads the run in the id parameter.
+// On failure, it writes the error to w and returns nil.
+func runFromRequest(w http.ResponseWriter, req *http.Request) *historyRun {
+	id, err := strconv.ParseInt(req.FormValue("id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, "id must be an integer")
+		return nil
+	}
+	run, err := loadRun(id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return nil
+	}
+	if run == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Run %d not found", id)
+		return nil
+	}
+	return run
+}
+
+const historyListLen = 200
+
+// historyJsonGet lists the recent runs, or returns a whole run given its id.
+func historyJsonGet(w http.ResponseWriter, req *http.Request) {
+	if !historyAuth(w, req) {
+		return
+	}
+	var res interface{}
+	if req.FormValue("id") != "" {
+		run := runFromRequest(w, req)
+		if run == nil {
+			return
+		}
+		res = run
+	} else {
+		runs, err := listRuns(historyListLen)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err)
+			return
+		}
+		res = runs
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// historyCsvGet downloads the result of a run again.
+func historyCsvGet(w http.ResponseWriter, req *http.Request) {
+	if !historyAuth(w, req) {
+		return
+	}
+	run := runFromRequest(w, req)
+	if run == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="solution-%d.csv"`, run.Id))
+	fmt.Fprint(w, run.ResultCsv)
+}
+
+// historyHtmlGet shows the list of runs, or a run with a form to run it again
+// with different parameters.
+func historyHtmlGet(w http.ResponseWriter, req *http.Request) {
+	if !historyAuth(w, req) {
+		return
+	}
+	var err error
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if req.FormValue("id") != "" {
+		run := runFromRequest(w, req)
+		if run == nil {
+			return
+		}
+		err = historyRunTmpl.Execute(w, run)
+	} else {
+		var runs []historyRun
+		runs, err = listRuns(historyListLen)
+		if err == nil {
+			err = historyListTmpl.Execute(w, runs)
+		}
+	}
+	if err != nil {
+		fmt.Fprint(w, err)
+	}
+}
+
+const historyStyle = `<style>
+	body {
+		padding: 10px;
+	}
+	h1 {
+		color: #00f;
+		font-size: 40px;
+	}
+	h1 > span {
+		color: #f0f;
+	}
+	td, th {
+		padding: 4px 10px;
+		text-align: left;
+	}
+	form {
+		width: 600px;
+		display: grid;
+		grid-template-columns: auto 350px;
+		gap: 13px;
+		margin-top: 20px;
+		margin-bottom: 20px;
+	}
+	form > span {
+		text-align: right;
+	}
+	pre {
+		max-height: 300px;
+		overflow: auto;
+		background: #eee;
+	}
+</style>`
+
+var historyListTmpl = template.Must(template.New("list").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="UTF-8">
+<title>taac! storico</title>
+` + historyStyle + `
+</head>
+
+<body>
+<h1>Taac<span>!</span> storico</h1>
+<p><a href="/compare.html">Confronta due ottimizzazioni</a></p>
+<table>
+	<tr><th>#</th><th>quando</th><th>chi</th><th>giorno</th><th>riders</th><th>durata</th><th>esito</th></tr>
+	{{range .}}
+	<tr>
+		<td><a href="/history.html?id={{.Id}}">{{.Id}}</a></td>
+		<td>{{.CreatedAt}}</td>
+		<td>{{.Operator}}</td>
+		<td>{{.Params.Date}}</td>
+		<td>{{.Params.Riders}}</td>
+		<td>{{.DurationMs}}ms</td>
+		<td>{{if .Error}}{{.Error}}{{else}}<a href="/history.csv?id={{.Id}}">solution.csv</a>{{end}}</td>
+	</tr>
+	{{end}}
+</table>
+</body>
+
+</html>
+`))
+
+var historyRunTmpl = template.Must(template.New("run").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="UTF-8">
+<title>taac! run {{.Id}}</title>
+` + historyStyle + `
+</head>
+
+<body>
+<h1>Taac<span>!</span> run {{.Id}}</h1>
+<p>{{.CreatedAt}}, {{.Operator}}, {{.DurationMs}}ms. <a href="/history.html">Torna allo storico</a></p>
+{{if .Error}}<p>Errore: {{.Error}}</p>{{else}}<p><a href="/history.csv?id={{.Id}}">Scarica solution.csv</a></p>{{end}}
+
+<h2>Rilancia con parametri diversi</h2>
+<form enctype="multipart/form-data" action="/solution.csv" method="post">
+	<input type="hidden" name="historyId" value="{{.Id}}">
+	<span>Data di consegna:</span>
+	<input type="date" name="date" value="{{.Params.Date}}" required>
+	<span>Lista di riders:</span>
+	<input type="text" name="riders" value="{{.Params.Riders}}" required>
+	<span>Numero di pacchi per bici:</span>
+	<input type="number" min="1" max="100" name="parcelsPerBike" value="{{.Params.ParcelsPerBike}}" required>
+	<span>Indirizzo di partenza riders:</span>
+	<input type="text" name="startAddress" value="{{.Params.StartAddress}}" required>
+	<span>Orario di inizio turno:</span>
+	<input type="time" name="startTime" value="{{.Params.StartTime}}" required>
+	<span>Orario di fine turno:</span>
+	<input type="time" name="endTime" value="{{.Params.EndTime}}" required>
+	<span>Operatore:</span>
+	<input type="text" name="operator" value="{{.Operator}}">
+	<span>Password:</span>
+	<input type="password" name="password" required>
+	<span></span>
+	<input type="submit" value="Go!">
+</form>
+
+<h2>Lista consegne</h2>
+<pre>{{.InputCsv}}</pre>
+<h2>Risultato</h2>
+<pre>{{.ResultCsv}}</pre>
+<h2>Geocodifiche</h2>
+<table>
+	{{range $addr, $loc := .Geocodes}}<tr><td>{{$addr}}</td><td>{{$loc.Lat}}, {{$loc.Lon}}</td></tr>{{end}}
+</table>
+<h2>Richiesta al solver</h2>
+<pre>{{printf "%s" .SolverRequest}}</pre>
+<h2>Risposta del solver</h2>
+<pre>{{printf "%s" .SolverResponse}}</pre>
+</body>
+
+</html>
+`))
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/robzan8/taac/shipments"
+)
+
+// A kpiRow aggregates the completed shipments of a period, and of a rider or customer.
+type kpiRow struct {
+	Period          string  `json:"period"`
+	Group           string  `json:"group,omitempty"` // rider or customer
+	Deliveries      int     `json:"deliveries"`
+	Failed          int     `json:"failed"`
+	Skipped         int     `json:"skipped"`           // delivered, but without a valid delivered_at
+	KmCycled        float64 `json:"km_cycled"`         // share of the planned routes
+	KmVanEquivalent float64 `json:"km_van_equivalent"` // from pickup to delivery, not the route cycled
+	AvgDelayMin     float64 `json:"avg_delay_min"`
+	OnTimeRate      float64 `json:"on_time_rate"`
+	Co2SavedKg      float64 `json:"co2_saved_kg"`
+	onTime          int
+	totalDelayMin   float64
+}
+
+// computeKpis aggregates the delivered and failed shipments of the days from..to
+// by period ("day", "week" or "month") and by groupBy ("rider", "customer" or "").
+// Kilometres cycled are the shares of the planned routes (shipments.Data.RouteKm),
+// for failed deliveries too. Van-equivalent kilometres are estimated from pickup
+// to delivery, which is what a van would drive instead, and converted to CO2
+// with conf.Kpi.VanCo2PerKm, in grams.
+// Delivered shipments without a valid delivery time are only counted as skipped.
+func computeKpis(ctx context.Context, ships []shipments.Shipment, from, to, period, groupBy string) ([]*kpiRow, error) {
+	rows := make(map[[2]string]*kpiRow)
+	for _, s := range ships {
+		d := s.Data
+		if d.ShipmentDay < from || d.ShipmentDay > to {
+			continue
+		}
+		if d.DeliveryStatus != shipments.StatusDelivered && d.DeliveryStatus != shipments.StatusFailed {
+			continue
+		}
+		day, err := time.Parse(dateLayout, d.ShipmentDay)
+		if err != nil {
+			return nil, fmt.Errorf("Error in shipment %s: %s", s.Id, err)
+		}
+		var key [2]string
+		switch period {
+		case "day":
+			key[0] = d.ShipmentDay
+		case "week":
+			y, w := day.ISOWeek()
+			key[0] = fmt.Sprintf("%d-W%02d", y, w)
+		default:
+			key[0] = day.Format("2006-01")
+		}
+		switch groupBy {
+		case "rider":
+			key[1] = d.RiderName
+		case "customer":
+			key[1] = s.User
+		}
+		row := rows[key]
+		if row == nil {
+			row = &kpiRow{Period: key[0], Group: key[1]}
+			rows[key] = row
+		}
+
+		if d.DeliveryStatus == shipments.StatusFailed {
+			row.Failed++
+			row.KmCycled += d.RouteKm
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, d.DeliveredAt); err != nil {
+			row.Skipped++
+			continue
+		}
+		row.Deliveries++
+		row.KmCycled += d.RouteKm
+		km, err := estimateKm(ctx, d.PickupAddress, d.DeliveryAddress)
+		if err != nil {
+			return nil, err
+		}
+		row.KmVanEquivalent += km
+		delay, err := deliveryDelay(s)
+		if err != nil {
+			return nil, err
+		}
+		if delay <= 0 {
+			row.onTime++
+		} else {
+			row.totalDelayMin += delay.Minutes()
+		}
+	}
+
+	var res []*kpiRow
+	for _, row := range rows {
+		if row.Deliveries > 0 {
+			row.AvgDelayMin = row.totalDelayMin / float64(row.Deliveries)
+			row.OnTimeRate = float64(row.onTime) / float64(row.Deliveries)
+		}
+		row.Co2SavedKg = row.KmVanEquivalent * conf.Kpi.VanCo2PerKm / 1000
+		res = append(res, row)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Period != res[j].Period {
+			return res[i].Period < res[j].Period
+		}
+		return res[i].Group < res[j].Group
+	})
+	return res, nil
+}
+
+// deliveryDelay is how late the shipment was delivered with respect to its time window,
+// or to its planned delivery time if it has none. Negative if early.
+// As when planning, a time window ending before the planned pickup is on the following day.
+func deliveryDelay(s shipments.Shipment) (time.Duration, error) {
+	d := s.Data
+	delivered, err := time.Parse(time.RFC3339, d.DeliveredAt)
+	if err != nil {
+		return 0, fmt.Errorf("Shipment %s has no valid delivery time", s.Id)
+	}
+	var latest int64
+	if d.LatestDeliveryTime != "" {
+		var pickup int64
+		if t, err := time.Parse(time.RFC3339, d.PickupTime); err == nil {
+			pickup = t.Unix()
+		}
+		latest, err = shipments.DeadlineTime(timeZone, d.ShipmentDay, d.LatestDeliveryTime, pickup)
+	} else {
+		latest, err = unixTime(d.ShipmentDay, d.DeliveryTime)
+		latest += int64(conf.Kpi.OnTime / time.Second)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Error in shipment %s: %s", s.Id, err)
+	}
+	return delivered.Sub(time.Unix(latest, 0)), nil
+}
+
+func kpiEndpoint(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		kpiGet(w, req)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unsupported method %s", req.Method)
+	}
+}
+
+// kpiGet reports the KPIs of the days from..to as /kpi.json or /kpi.csv.
+func kpiGet(w http.ResponseWriter, req *http.Request) {
+	authHeader, _, ok := authenticate(w, req)
+	if !ok {
+		return
+	}
+	var err error // beware of shadowing
+	defer func() {
+		if err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			fmt.Fprintf(w, "%s", err)
+		}
+	}()
+
+	from, to := req.FormValue("from"), req.FormValue("to")
+	if !dateRegex.MatchString(from) || !dateRegex.MatchString(to) {
+		err = errors.New("from and to must be in the format 2022-12-31")
+		return
+	}
+	period := req.FormValue("period")
+	if period == "" {
+		period = "month"
+	}
+	groupBy := req.FormValue("by")
+	if (period != "day" && period != "week" && period != "month") ||
+		(groupBy != "" && groupBy != "rider" && groupBy != "customer") {
+		err = errors.New("period must be day, week or month and by must be rider or customer")
+		return
+	}
+	shipData, err := backend.Shipments(req.Context(), authHeader)
+	if err != nil {
+		return
+	}
+	rows, err := computeKpis(req.Context(), shipData, from, to, period, groupBy)
+	if err != nil {
+		return
+	}
+
+	if req.URL.Path == "/kpi.json" {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(rows)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	err = writeCsvKpis(w, rows)
+}
+
+func writeCsvKpis(w http.ResponseWriter, rows []*kpiRow) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{
+		"periodo", "gruppo", "consegne", "fallite", "saltate", "km in bici", "km equivalenti furgone",
+		"ritardo medio (min)", "puntualità", "CO2 risparmiata (kg)",
+	})
+	if err != nil {
+		return err
+	}
+	for _, r := range rows {
+		err = cw.Write([]string{
+			r.Period, r.Group, strconv.Itoa(r.Deliveries), strconv.Itoa(r.Failed), strconv.Itoa(r.Skipped),
+			strconv.FormatFloat(r.KmCycled, 'f', 1, 64),
+			strconv.FormatFloat(r.KmVanEquivalent, 'f', 1, 64),
+			strconv.FormatFloat(r.AvgDelayMin, 'f', 1, 64),
+			strconv.FormatFloat(r.OnTimeRate, 'f', 3, 64),
+			strconv.FormatFloat(r.Co2SavedKg, 'f', 2, 64),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
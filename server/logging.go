@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// jsonLogWriter turns the lines of the standard logger into JSON objects,
+// so that the messages logged with log.Printf are structured too.
+type jsonLogWriter struct{}
+
+func (jsonLogWriter) Write(p []byte) (int, error) {
+	logJson(map[string]interface{}{
+		"level": "info",
+		"msg":   strings.TrimSuffix(string(p), "\n"),
+	})
+	return len(p), nil
+}
+
+// logJson writes fields as a line of JSON to stderr, adding the time.
+func logJson(fields map[string]interface{}) {
+	fields["time"] = time.Now().In(time.UTC).Format(time.RFC3339Nano)
+	line, err := json.Marshal(fields)
+	if err != nil {
+		line, _ = json.Marshal(map[string]interface{}{"level": "error", "msg": err.Error()})
+	}
+	os.Stderr.Write(append(line, '\n'))
+}
+
+// logReq logs msg at level (info, warn or error) with the id of the request it concerns.
+func logReq(req *http.Request, level, msg string) {
+	logJson(map[string]interface{}{
+		"level":      level,
+		"msg":        msg,
+		"request_id": requestId(req.Context()),
+	})
+}
+
+type requestIdKey struct{}
+
+func requestId(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// statusRecorder remembers the status code and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.size += n
+	return n, err
+}
+
+// instrument serves the requests with mux, giving each an id, logging it
+// and measuring it. The id is taken from the X-Request-Id header if present,
+// as set by the Heroku router, and is returned in the response.
+func instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		id := req.Header.Get("X-Request-Id")
+		if id == "" {
+			id = randomId()
+		}
+		w.Header().Set("X-Request-Id", id)
+		req = req.WithContext(context.WithValue(req.Context(), requestIdKey{}, id))
+
+		rec := &statusRecorder{ResponseWriter: w}
+		mux.ServeHTTP(rec, req)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		_, pattern := mux.Handler(req) // not the path, to bound the number of series
+		elapsed := time.Since(start)
+		httpRequests.add(labels("endpoint", pattern, "code", strconv.Itoa(rec.status)), 1)
+		httpDuration.observe(labels("endpoint", pattern), elapsed.Seconds())
+		level := "info"
+		if rec.status >= 500 {
+			level = "error"
+		} else if rec.status >= 400 {
+			level = "warn"
+		}
+		logJson(map[string]interface{}{
+			"level":       level,
+			"msg":         "request",
+			"request_id":  id,
+			"method":      req.Method,
+			"path":        req.URL.Path,
+			"status":      rec.status,
+			"bytes":       rec.size,
+			"duration_ms": elapsed.Milliseconds(),
+			"remote":      req.RemoteAddr,
+		})
+	})
+}
@@ -1,53 +1,207 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"time"
+	_ "time/tzdata" // in case the host has no timezone database
+
+	"github.com/robzan8/taac/backend/graphql"
+	"github.com/robzan8/taac/config"
+	"github.com/robzan8/taac/geocode"
+	"github.com/robzan8/taac/shipments"
+	"github.com/robzan8/taac/vrp"
 )
 
 var (
-	port        = os.Getenv("PORT")
-	geocodeKey  = os.Getenv("GEOCODE_KEY")
-	routeoptKey = os.Getenv("ROUTEOPT_KEY")
-	password    = os.Getenv("PASSWORD")
+	// Loaded at startup from the config file and the environment.
+	conf config.Config
+
+	// How recipients are told about their shipments, none if empty.
+	notifiers []notifier
+
+	// Where proof of delivery files are kept.
+	podStore blobStore
+
+	// Times of day in input are in this timezone.
+	timeZone *time.Location
+
+	// Where riders and shipments are kept.
+	backend *graphql.Client
+
+	// Geocoding and route optimization, see newPlanner.
+	geocoder *geocode.Client
+	solver   *vrp.Solver
+	planner  *shipments.Planner
 
 	dateRegex, _ = regexp.Compile(`^\d{4}-[0-1]\d-[0-3]\d$`)
 )
 
+// loadConfig reads the configuration of the server, see package config.
+func loadConfig(path string) (config.Config, error) {
+	c, err := config.Load(path)
+	if err != nil {
+		return c, err
+	}
+	return c, c.Validate(true)
+}
+
 func main() {
-	if port == "" || geocodeKey == "" || routeoptKey == "" || password == "" {
-		log.Fatal("Some environment variable not set")
+	log.SetFlags(0)
+	log.SetOutput(jsonLogWriter{})
+
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "YAML config `file`, overridden by the environment")
+	checkConfig := flag.Bool("check-config", false, "validate the configuration, print it and exit")
+	flag.Parse()
+
+	var err error
+	conf, err = loadConfig(*configPath)
+	if *checkConfig {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Print(conf.Summary())
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	timeZone, err = time.LoadLocation(conf.Server.Timezone)
+	if err != nil {
+		log.Fatalf("Invalid timezone: %s", err)
+	}
+	backend = graphql.NewClient(conf.Graphql)
+	backend.OnCall = func(start time.Time, err error) { observeCall("graphql", start, err) }
+	geocoder, solver, planner = newPlanner()
+	err = useCassette()
+	if err != nil {
+		log.Fatalf("Cassette: %s", err)
+	}
+	notifiers = newNotifiers()
+	err = openHistory(conf.Server.HistoryDb)
+	if err != nil {
+		log.Fatalf("Opening history database: %s", err)
+	}
+	err = loadGeocodeCache()
+	if err != nil {
+		log.Fatalf("Loading geocode cache: %s", err)
+	}
+	podStore, err = newBlobStore()
+	if err != nil {
+		log.Fatalf("Proof of delivery storage: %s", err)
 	}
 
 	rand.Seed(time.Now().UnixNano())
 
-	http.Handle("/", http.FileServer(http.Dir("./server/static")))
-	http.HandleFunc("/solution.csv", csvEndpoint)
-	http.HandleFunc("/schedule.txt", scheduleEndpoint)
+	serve(instrument(routes()))
+}
 
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+// routes returns the handlers of all the endpoints.
+func routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	api := func(h http.HandlerFunc) http.HandlerFunc {
+		return allowOrigins(conf.Server.ScheduleOrigins, h)
+	}
+	mux.Handle("/", http.FileServer(http.Dir("./server/static")))
+	mux.HandleFunc("/solution.csv", allowOrigins(conf.Server.CsvOrigins, withDeadline(csvEndpoint)))
+	mux.HandleFunc("/schedule.txt", api(withDeadline(scheduleEndpoint)))
+	mux.HandleFunc("/replan.txt", api(withDeadline(replanEndpoint)))
+	mux.HandleFunc("/status.txt", api(statusEndpoint))
+	mux.HandleFunc("/proof.txt", api(proofEndpoint))
+	mux.HandleFunc(proofUrlPrefix, api(proofFileGet))
+	mux.HandleFunc("/shipment.html", api(shipmentReportGet))
+	mux.HandleFunc("/position.json", api(positionEndpoint))
+	mux.HandleFunc("/eta.json", api(etaEndpoint))
+	mux.HandleFunc("/webhooks.json", api(webhooksEndpoint))
+	mux.HandleFunc("/history.html", historyHtmlGet)
+	mux.HandleFunc("/history.json", historyJsonGet)
+	mux.HandleFunc("/history.csv", historyCsvGet)
+	mux.HandleFunc("/compare.html", compareEndpoint)
+	mux.HandleFunc("/compare.json", compareEndpoint)
+	mux.HandleFunc("/kpi.json", api(kpiEndpoint))
+	mux.HandleFunc("/kpi.csv", api(kpiEndpoint))
+	mux.HandleFunc("/metrics", metricsEndpoint)
+	mux.HandleFunc("/healthz", healthzEndpoint)
+	mux.HandleFunc("/readyz", readyzEndpoint)
+	return mux
 }
 
-func setAllowOrigins(h http.Header) { h.Set("Access-Control-Allow-Origin", "*") }
+const dateLayout = shipments.DateLayout
 
-func formatHourMin(unixTime int64) string {
-	minutes := unixTime / 60
-	min := minutes % 60
-	hour := (minutes / 60) % 24
-	return fmt.Sprintf("%02d:%02d", hour, min)
+// withDeadline cancels the plans of h a tenth of conf.Server.WriteTimeout before it
+// expires, leaving the time to answer with the error: afterwards, the connection
+// is closed and the client could not get the plan anyway.
+func withDeadline(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), conf.Server.WriteTimeout*9/10)
+		defer cancel()
+		h(w, req.WithContext(ctx))
+	}
 }
 
-// hourMin is in the format "23:59"
-func unixTime(hourMin string) (int64, error) {
-	var hour, min int64
-	_, err := fmt.Sscanf(hourMin, "%d:%d", &hour, &min)
-	if err != nil || hour < 0 || hour > 23 || min < 0 || min > 59 {
-		return 0, fmt.Errorf("Wrongly formatted time %q", hourMin)
+// allowOrigins wraps h with the CORS checks of setAllowOrigins: requests from
+// disallowed origins get 403 and preflight requests are answered without calling h.
+func allowOrigins(allowed []string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !setAllowOrigins(w.Header(), req, allowed) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "Origin not allowed")
+			return
+		}
+		if req.Method == http.MethodOptions {
+			return
+		}
+		h(w, req)
 	}
-	return (hour*60 + min) * 60, nil
+}
+
+// setAllowOrigins sets the CORS headers if the request origin is in allowed.
+// It returns false if the request comes from a browser with a disallowed origin.
+// Same-origin requests, like the forms of the bundled pages, are always allowed.
+func setAllowOrigins(h http.Header, req *http.Request, allowed []string) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true // not a cross-origin browser request
+	}
+	h.Add("Vary", "Origin")
+	if u, err := url.Parse(origin); err == nil && u.Host == req.Host {
+		return true
+	}
+	for _, o := range allowed {
+		if o == "*" || o == origin {
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			h.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			return true
+		}
+	}
+	return false
+}
+
+// formatTime formats a unix timestamp as ISO 8601 in timeZone.
+func formatTime(unixTime int64) string {
+	return shipments.FormatTime(timeZone, unixTime)
+}
+
+// formatHourMin formats a unix timestamp as "23:59" in timeZone.
+func formatHourMin(unixTime int64) string {
+	return time.Unix(unixTime, 0).In(timeZone).Format("15:04")
+}
+
+// unixTime converts a time of day on date in timeZone to a unix timestamp, see shipments.UnixTime.
+func unixTime(date, hourMin string) (int64, error) {
+	return shipments.UnixTime(timeZone, date, hourMin)
+}
+
+// shiftTimes returns the start and end timestamps of a shift on date, see shipments.ShiftTimes.
+func shiftTimes(date, start, end string) (startTime, endTime int64, err error) {
+	return shipments.ShiftTimes(timeZone, date, start, end)
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robzan8/taac/backend/graphql"
+	"github.com/robzan8/taac/fake"
+	"github.com/robzan8/taac/shipments"
+	"github.com/robzan8/taac/vrp"
+)
+
+// Owner of the riders and shipments of the tests.
+const testUser = "test-user"
+
+// startFakes serves the fakes and sets up the server against them,
+// configured only by fake.Services.Env as a deployment would be.
+func startFakes(t *testing.T) *fake.Services {
+	t.Helper()
+	s := fake.Start()
+	t.Cleanup(s.Close)
+	for _, v := range s.Env(s.Server.URL) {
+		kv := strings.SplitN(v, "=", 2)
+		t.Setenv(kv[0], kv[1])
+	}
+	t.Setenv("HISTORY_DB", filepath.Join(t.TempDir(), "taac.db"))
+
+	var err error
+	conf, err = loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeZone, err = time.LoadLocation(conf.Server.Timezone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend = graphql.NewClient(conf.Graphql)
+	geocoder, solver, planner = newPlanner()
+	notifiers = nil
+	// Every Auth fake has a key of its own.
+	jwksMu.Lock()
+	jwksKeys, jwksFetched = make(map[string]*rsa.PublicKey), time.Time{}
+	jwksMu.Unlock()
+	err = openHistory(conf.Server.HistoryDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { historyDb.Close() })
+	return s
+}
+
+// addRiders adds riders with the given names to the backend, on a cargo bike from 9 to 17.
+func addRiders(t *testing.T, s *fake.Services, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		var r shipments.Rider
+		r.Data.Name = name
+		r.Data.VehicleTypeId = vrp.CargoBike.Id
+		r.Data.StartAddress = "Piazza Duomo Milano"
+		r.Data.EarliestStart = "09:00"
+		r.Data.LatestEnd = "17:00"
+		err := s.Backend.AddRiders(testUser, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// addShipments adds a shipment to be scheduled for each delivery address.
+func addShipments(t *testing.T, s *fake.Services, deliveryAddrs ...string) {
+	t.Helper()
+	for _, addr := range deliveryAddrs {
+		var sh shipments.Shipment
+		sh.Data.Size = 10
+		sh.Data.PickupAddress = "Via Roma 1 Milano"
+		sh.Data.DeliveryAddress = addr
+		sh.Data.DeliveryStatus = shipments.StatusToBeScheduled
+		err := s.Backend.AddShipments(testUser, sh)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// do runs req through the routes of the server, as the test user.
+func do(t *testing.T, s *fake.Services, req *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	req.Header.Set("Authorization", "Bearer "+s.Auth.Token(testUser, "", []string{"user"}, time.Hour))
+	rec := httptest.NewRecorder()
+	routes().ServeHTTP(rec, req)
+	return rec
+}
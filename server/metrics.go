@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A metric is a Prometheus counter, gauge or histogram, with a series per set of labels.
+type metric struct {
+	name, help, kind string
+	buckets          []float64 // upper bounds, histograms only
+
+	mu     sync.Mutex
+	series map[string]*series // by labels, as in `call="solve",result="ok"`
+}
+
+type series struct {
+	value   float64 // counters and gauges
+	count   uint64  // histograms
+	sum     float64
+	buckets []uint64 // observations in each bucket, not cumulative
+}
+
+var (
+	durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+	sizeBuckets     = []float64{2, 5, 10, 20, 30, 50, 100, 200, 500}
+
+	httpRequests = newMetric("taac_http_requests_total", "counter",
+		"HTTP requests by endpoint and status code.", nil)
+	httpDuration = newMetric("taac_http_request_duration_seconds", "histogram",
+		"Time to serve HTTP requests, by endpoint.", durationBuckets)
+	externalCalls = newMetric("taac_external_calls_total", "counter",
+		"Calls to external services by call and result (ok or error).", nil)
+	externalDuration = newMetric("taac_external_call_duration_seconds", "histogram",
+		"Duration of calls to external services.", durationBuckets)
+	geocodeCacheRequests = newMetric("taac_geocode_cache_requests_total", "counter",
+		"Geocode cache lookups by result (hit or miss).", nil)
+	geocodeCacheSize = newMetric("taac_geocode_cache_size", "gauge",
+		"Addresses in the geocode cache.", nil)
+	solverLocations = newMetric("taac_solver_problem_locations", "histogram",
+		"Distinct locations of the problems given to Solve.", sizeBuckets)
+	solverShipments = newMetric("taac_solver_problem_shipments", "histogram",
+		"Shipments of the problems given to Solve.", sizeBuckets)
+	solverVehicles = newMetric("taac_solver_problem_vehicles", "histogram",
+		"Vehicles of the problems given to Solve.", sizeBuckets)
+)
+
+var metrics []*metric // in order of registration
+
+func newMetric(name, kind, help string, buckets []float64) *metric {
+	m := &metric{name: name, help: help, kind: kind, buckets: buckets, series: make(map[string]*series)}
+	metrics = append(metrics, m)
+	return m
+}
+
+// labels formats label names and values, given in pairs, as in `name="value"`.
+func labels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(pairs[i+1]))
+	}
+	return b.String()
+}
+
+func (m *metric) get(labels string) *series {
+	s := m.series[labels]
+	if s == nil {
+		s = &series{buckets: make([]uint64, len(m.buckets))}
+		m.series[labels] = s
+	}
+	return s
+}
+
+// add adds v to a counter.
+func (m *metric) add(labels string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.get(labels).value += v
+}
+
+// set sets a gauge to v.
+func (m *metric) set(labels string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.get(labels).value = v
+}
+
+// observe records v in a histogram.
+func (m *metric) observe(labels string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.get(labels)
+	s.count++
+	s.sum += v
+	for i, le := range m.buckets {
+		if v <= le {
+			s.buckets[i]++
+			break
+		}
+	}
+}
+
+// observeCall records the outcome and duration of a call to an external service.
+func observeCall(call string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	externalCalls.add(labels("call", call, "result", result), 1)
+	externalDuration.observe(labels("call", call), time.Since(start).Seconds())
+}
+
+// writeTo writes m in the Prometheus text format.
+func (m *metric) writeTo(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, braces(k), formatFloat(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, le := range m.buckets {
+			cumulative += s.buckets[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, braces(k, labels("le", formatFloat(le))), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, braces(k, `le="+Inf"`), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, braces(k), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, braces(k), s.count)
+	}
+}
+
+func braces(labels ...string) string {
+	var nonEmpty []string
+	for _, l := range labels {
+		if l != "" {
+			nonEmpty = append(nonEmpty, l)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(nonEmpty, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func metricsEndpoint(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.writeTo(bw)
+	}
+	bw.Flush()
+}
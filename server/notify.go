@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/robzan8/taac/shipments"
+)
+
+// A notifier delivers a message to a recipient, by email or SMS.
+type notifier interface {
+	// Recipient extracts the address of the recipient from a shipment, "" if unknown.
+	Recipient(ship shipments.Shipment) string
+	Send(to, subject, body string) error
+}
+
+// newNotifiers returns the notifiers that are configured:
+// email if the SMTP server is set, SMS if the gateway is set.
+func newNotifiers() []notifier {
+	var ns []notifier
+	if n := conf.Notify; n.SmtpAddr != "" {
+		ns = append(ns, emailNotifier{
+			Addr:     n.SmtpAddr,
+			From:     n.SmtpFrom,
+			User:     n.SmtpUser,
+			Password: n.SmtpPassword,
+		})
+	}
+	if n := conf.Notify; n.SmsUrl != "" {
+		ns = append(ns, smsNotifier{Url: n.SmsUrl, Key: n.SmsKey})
+	}
+	return ns
+}
+
+var (
+	emailRegex = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	phoneRegex = regexp.MustCompile(`\+?\d[\d ]{7,14}\d`)
+)
+
+// emailNotifier sends emails through an SMTP server, e.g. a local MailHog on localhost:1025.
+type emailNotifier struct {
+	Addr     string
+	From     string
+	User     string
+	Password string
+}
+
+// Recipient returns the bare address of the recipient,
+// "" if the shipment's email is not a valid address.
+func (n emailNotifier) Recipient(ship shipments.Shipment) string {
+	email := ship.Data.RecipientEmail
+	if email == "" {
+		email = emailRegex.FindString(ship.Data.Notes)
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return ""
+	}
+	return addr.Address
+}
+
+func (n emailNotifier) Send(to, subject, body string) error {
+	// Addresses and subject end up in the headers, where a newline would start a new one.
+	addr, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("Invalid recipient %q: %s", to, err)
+	}
+	to = addr.Address
+	msg := "From: " + n.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + body
+
+	// Like smtp.SendMail, but bounded by conf.Notify.SmtpTimeout,
+	// so that an unresponsive server cannot hold the shutdown.
+	dialer := net.Dialer{Timeout: conf.Notify.SmtpTimeout}
+	conn, err := dialer.Dial("tcp", n.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(conf.Notify.SmtpTimeout))
+	if err != nil {
+		return err
+	}
+	host, _, err := net.SplitHostPort(n.Addr)
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if n.User != "" {
+		err = c.Auth(smtp.PlainAuth("", n.User, n.Password, host))
+		if err != nil {
+			return err
+		}
+	}
+	err = c.Mail(n.From)
+	if err != nil {
+		return err
+	}
+	err = c.Rcpt(to)
+	if err != nil {
+		return err
+	}
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = wc.Write([]byte(msg))
+	if err != nil {
+		return err
+	}
+	err = wc.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// smsNotifier posts {"to": ..., "text": ...} to an HTTP SMS gateway.
+// Gateways with a different API can be put behind a small adapter.
+type smsNotifier struct {
+	Url string
+	Key string
+}
+
+func (n smsNotifier) Recipient(ship shipments.Shipment) string {
+	phone := ship.Data.RecipientPhone
+	if phone == "" {
+		phone = phoneRegex.FindString(ship.Data.Notes)
+	}
+	return strings.ReplaceAll(phone, " ", "")
+}
+
+func (n smsNotifier) Send(to, subject, body string) error {
+	payload, err := json.Marshal(map[string]string{"to": to, "text": body})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), conf.Notify.SmsTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.Url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.Key != "" {
+		req.Header.Set("Authorization", "Bearer "+n.Key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("SMS gateway responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Half width of the delivery window communicated to recipients.
+const deliveryWindowMargin = 30 * time.Minute
+
+// notifyShipments tells the recipients of ships about their current status,
+// in the background. Statuses without a template are not notified.
+func notifyShipments(ships []shipments.Shipment) {
+	if len(notifiers) == 0 {
+		return
+	}
+	for _, s := range ships {
+		lang := s.Data.Language
+		if notifyTemplates[lang] == nil {
+			lang = "it"
+		}
+		tmpl := notifyTemplates[lang][s.Data.DeliveryStatus]
+		if tmpl == nil {
+			continue
+		}
+		subject, body, err := renderNotification(tmpl, s)
+		if err != nil {
+			log.Printf("Notification for shipment %s: %s", s.Id, err)
+			continue
+		}
+		for _, n := range notifiers {
+			to := n.Recipient(s)
+			if to == "" {
+				continue
+			}
+			n, id := n, s.Id
+			started := goBackground(func() {
+				err := n.Send(to, subject, body)
+				if err != nil {
+					log.Printf("Notification for shipment %s to %s: %s", id, to, err)
+				}
+			})
+			if !started {
+				log.Printf("Notification for shipment %s to %s: not sent, shutting down", id, to)
+			}
+		}
+	}
+}
+
+func renderNotification(tmpl *template.Template, ship shipments.Shipment) (subject, body string, err error) {
+	data := struct {
+		Ship        shipments.Shipment
+		Day         string
+		WindowStart string
+		WindowEnd   string
+	}{Ship: ship}
+	if t, err := time.Parse(time.RFC3339, ship.Data.DeliveryTime); err == nil {
+		t = t.In(timeZone)
+		data.Day = t.Format("02/01/2006")
+		data.WindowStart = t.Add(-deliveryWindowMargin).Format("15:04")
+		data.WindowEnd = t.Add(deliveryWindowMargin).Format("15:04")
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", "", err
+	}
+	// The first line is the subject.
+	parts := strings.SplitN(buf.String(), "\n", 2)
+	if len(parts) < 2 {
+		return "", "", fmt.Errorf("Template %s has no body", tmpl.Name())
+	}
+	return parts[0], strings.TrimSpace(parts[1]), nil
+}
+
+// Templates by language and delivery status.
+var notifyTemplates = map[string]map[string]*template.Template{
+	"it": {
+		shipments.StatusScheduled: template.Must(template.New("it-scheduled").Parse(
+			`La tua consegna è in programma
+La consegna all'indirizzo {{.Ship.Data.DeliveryAddress}} è prevista il {{.Day}} tra le {{.WindowStart}} e le {{.WindowEnd}}.`)),
+		shipments.StatusPickedUp: template.Must(template.New("it-picked_up").Parse(
+			`La tua consegna è in arrivo
+Il rider {{.Ship.Data.RiderName}} ha ritirato il pacco e arriverà all'indirizzo {{.Ship.Data.DeliveryAddress}} tra le {{.WindowStart}} e le {{.WindowEnd}}.`)),
+		shipments.StatusDelivered: template.Must(template.New("it-delivered").Parse(
+			`Consegna effettuata
+Il pacco è stato consegnato all'indirizzo {{.Ship.Data.DeliveryAddress}}. Grazie!`)),
+		shipments.StatusFailed: template.Must(template.New("it-failed").Parse(
+			`Consegna non riuscita
+Non è stato possibile consegnare il pacco all'indirizzo {{.Ship.Data.DeliveryAddress}}: {{.Ship.Data.FailureReason}}. Ti contatteremo per una nuova consegna.`)),
+		shipments.StatusCanceled: template.Must(template.New("it-canceled").Parse(
+			`Consegna annullata
+La consegna all'indirizzo {{.Ship.Data.DeliveryAddress}} è stata annullata.`)),
+	},
+	"en": {
+		shipments.StatusScheduled: template.Must(template.New("en-scheduled").Parse(
+			`Your delivery is scheduled
+The delivery to {{.Ship.Data.DeliveryAddress}} is expected on {{.Day}} between {{.WindowStart}} and {{.WindowEnd}}.`)),
+		shipments.StatusPickedUp: template.Must(template.New("en-picked_up").Parse(
+			`Your delivery is on its way
+Rider {{.Ship.Data.RiderName}} picked up the parcel and will arrive at {{.Ship.Data.DeliveryAddress}} between {{.WindowStart}} and {{.WindowEnd}}.`)),
+		shipments.StatusDelivered: template.Must(template.New("en-delivered").Parse(
+			`Delivered
+The parcel has been delivered to {{.Ship.Data.DeliveryAddress}}. Thank you!`)),
+		shipments.StatusFailed: template.Must(template.New("en-failed").Parse(
+			`Delivery failed
+We could not deliver the parcel to {{.Ship.Data.DeliveryAddress}}: {{.Ship.Data.FailureReason}}. We will contact you for a new delivery.`)),
+		shipments.StatusCanceled: template.Must(template.New("en-canceled").Parse(
+			`Delivery canceled
+The delivery to {{.Ship.Data.DeliveryAddress}} has been canceled.`)),
+	},
+}
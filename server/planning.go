@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/robzan8/taac/cassette"
+	"github.com/robzan8/taac/geocode"
+	"github.com/robzan8/taac/shipments"
+	"github.com/robzan8/taac/vrp"
+)
+
+// newPlanner builds the geocoder, solver and planner from conf, reporting to the metrics.
+func newPlanner() (*geocode.Client, *vrp.Solver, *shipments.Planner) {
+	g := geocode.NewClient(conf.Geocode)
+	g.OnLookup = func(hit bool) {
+		result := "miss"
+		if hit {
+			result = "hit"
+		}
+		geocodeCacheRequests.add(labels("result", result), 1)
+	}
+	g.OnStore = func(cacheSize int) { geocodeCacheSize.set("", float64(cacheSize)) }
+	g.OnCall = func(start time.Time, err error) { observeCall("geocode", start, err) }
+
+	s := vrp.NewSolver(conf.Routeopt)
+	s.OnSolve = func(prob vrp.Problem) {
+		solverLocations.observe("", float64(vrp.NumLocations(prob)))
+		solverShipments.observe("", float64(len(prob.Shipments)))
+		solverVehicles.observe("", float64(len(prob.Vehicles)))
+	}
+	s.OnCall = func(start time.Time, err error) { observeCall("solve", start, err) }
+
+	p := shipments.NewPlanner(g, s, timeZone)
+	p.VehicleTypes = conf.VehicleTypes
+	p.PickupTime = conf.Schedule.PickupTime
+	p.DeliveryTime = conf.Schedule.DeliveryTime
+	return g, s, p
+}
+
+// useCassette makes the geocoder, solver and backend record their traffic
+// to conf.Cassette.Record, or replay it from conf.Cassette.Replay.
+// Tokens are still verified against the live JWKS, see the README.
+func useCassette() error {
+	var transport http.RoundTripper
+	switch {
+	case conf.Cassette.Record != "":
+		rec, err := cassette.NewRecorder(conf.Cassette.Record, http.DefaultTransport)
+		if err != nil {
+			return err
+		}
+		log.Printf("Recording outbound traffic to %s", conf.Cassette.Record)
+		transport = rec
+	case conf.Cassette.Replay != "":
+		player, err := cassette.Load(conf.Cassette.Replay)
+		if err != nil {
+			return err
+		}
+		log.Printf("Replaying outbound traffic from %s, tokens are verified against %s", conf.Cassette.Replay, conf.Auth.JwksUrl)
+		transport = player
+	default:
+		return nil
+	}
+	client := &http.Client{Transport: transport}
+	geocoder.HTTPClient = client
+	solver.HTTPClient = client
+	backend.HTTPClient = client
+	return nil
+}
+
+// loadGeocodeCache fills the cache with the geocodes saved at the last shutdown.
+func loadGeocodeCache() error {
+	rows, err := historyDb.Query(`SELECT address, lat, lon FROM geocodes LIMIT ?`, conf.Geocode.CacheSize)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var addr string
+		var loc geocode.Location
+		err = rows.Scan(&addr, &loc.Lat, &loc.Lon)
+		if err != nil {
+			return err
+		}
+		geocoder.Store(addr, loc)
+	}
+	return rows.Err()
+}
+
+// saveGeocodeCache replaces the saved geocodes with the content of the cache.
+func saveGeocodeCache() error {
+	tx, err := historyDb.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`DELETE FROM geocodes`)
+	if err != nil {
+		return err
+	}
+	for addr, loc := range geocoder.Cached() {
+		_, err = tx.Exec(`INSERT INTO geocodes (address, lat, lon) VALUES (?, ?, ?)`, addr, loc.Lat, loc.Lon)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
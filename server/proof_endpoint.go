@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/robzan8/taac/shipments"
+)
+
+// shipments.Proof links the files uploaded by the rider, as /proof/ urls.
+const (
+	maxProofFileSize = 10 << 20 // 10MB
+	proofUrlPrefix   = "/proof/"
+)
+
+func proofEndpoint(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		proofPost(w, req)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unsupported method %s", req.Method)
+	}
+}
+
+// proofPost stores the photo and/or signature image uploaded for a shipment,
+// together with the name of the recipient.
+func proofPost(w http.ResponseWriter, req *http.Request) {
+	authHeader, _, ok := authenticate(w, req)
+	if !ok {
+		return
+	}
+
+	var err error // beware of shadowing
+	defer func() {
+		if err != nil {
+			w.WriteHeader(errorStatus(err))
+			fmt.Fprintf(w, "%s", err)
+		}
+	}()
+
+	req.Body = http.MaxBytesReader(w, req.Body, 2*maxProofFileSize+1<<20)
+	shipId := req.FormValue("shipmentId")
+	recipient := strings.TrimSpace(req.FormValue("recipientName"))
+	if shipId == "" || recipient == "" {
+		err = errors.New("shipmentId and recipientName are required")
+		return
+	}
+
+	ship, err := backend.Shipment(req.Context(), authHeader, shipId)
+	if err != nil {
+		return
+	}
+	if ship == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Shipment %s not found", shipId)
+		return
+	}
+	switch ship.Data.DeliveryStatus {
+	case shipments.StatusPickedUp, shipments.StatusDelivered:
+		// OK
+	default:
+		err = fmt.Errorf("Shipment %s is %q, proof of delivery can't be recorded", shipId, ship.Data.DeliveryStatus)
+		return
+	}
+
+	versions := shipmentVersions([]shipments.Shipment{*ship}, []shipments.Shipment{*ship})
+	now := time.Now()
+	proof := shipments.Proof{
+		RecipientName: recipient,
+		RecordedAt:    now.In(timeZone).Format(time.RFC3339),
+	}
+	proof.PhotoUrl, err = storeProofFile(req, "photo", ship.Id, now)
+	if err != nil {
+		return
+	}
+	proof.SignatureUrl, err = storeProofFile(req, "signature", ship.Id, now)
+	if err != nil {
+		return
+	}
+	if proof.PhotoUrl == "" && proof.SignatureUrl == "" {
+		err = errors.New("A photo or a signature is required")
+		return
+	}
+	ship.Data.Proof = &proof
+	err = writeShipments(req.Context(), authHeader, []shipments.Shipment{*ship}, versions)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "Proof of delivery recorded for shipment %s", shipId)
+}
+
+// storeProofFile stores the image in the form field, if present, and returns its url.
+func storeProofFile(req *http.Request, field, shipId string, now time.Time) (string, error) {
+	f, _, err := req.FormFile(field)
+	if err == http.ErrMissingFile {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxProofFileSize {
+		return "", fmt.Errorf("The %s must be at most %dMB", field, maxProofFileSize>>20)
+	}
+	var ext string
+	contentType := http.DetectContentType(data)
+	switch contentType {
+	case "image/png":
+		ext = ".png"
+	case "image/jpeg":
+		ext = ".jpg"
+	default:
+		return "", fmt.Errorf("The %s must be a PNG or JPEG image", field)
+	}
+	key := fmt.Sprintf("%s/%s-%d%s", shipId, field, now.Unix(), ext)
+	err = podStore.Put(req.Context(), key, contentType, data)
+	if err != nil {
+		return "", err
+	}
+	return proofUrlPrefix + key, nil
+}
+
+// proofFileGet serves the files linked by shipments.Proof. The shipment is read
+// with the caller's token first, so that the nhost permissions apply to its files too.
+func proofFileGet(w http.ResponseWriter, req *http.Request) {
+	authHeader, _, ok := authenticate(w, req)
+	if !ok {
+		return
+	}
+	key := strings.TrimPrefix(req.URL.Path, proofUrlPrefix)
+	shipId := strings.SplitN(key, "/", 2)[0]
+	ship, err := backend.Shipment(req.Context(), authHeader, shipId)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		fmt.Fprint(w, err)
+		return
+	}
+	if ship == nil || ship.Data.Proof == nil ||
+		(ship.Data.Proof.PhotoUrl != req.URL.Path && ship.Data.Proof.SignatureUrl != req.URL.Path) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, errBlobNotFound)
+		return
+	}
+	data, contentType, err := podStore.Get(req.Context(), key)
+	if err == errBlobNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(data)
+}
+
+// shipmentReportGet renders a shipment, with its status history and proof of delivery,
+// as a self-contained HTML page that can be forwarded to the customer.
+func shipmentReportGet(w http.ResponseWriter, req *http.Request) {
+	authHeader, _, ok := authenticate(w, req)
+	if !ok {
+		return
+	}
+	var err error // beware of shadowing
+	defer func() {
+		if err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			fmt.Fprintf(w, "%s", err)
+		}
+	}()
+
+	ship, err := backend.Shipment(req.Context(), authHeader, req.FormValue("shipmentId"))
+	if err != nil {
+		return
+	}
+	if ship == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Shipment not found")
+		return
+	}
+	report := struct {
+		Ship      *shipments.Shipment
+		Photo     template.URL
+		Signature template.URL
+	}{Ship: ship}
+	if p := ship.Data.Proof; p != nil {
+		report.Photo, err = proofDataUrl(req.Context(), p.PhotoUrl)
+		if err != nil {
+			return
+		}
+		report.Signature, err = proofDataUrl(req.Context(), p.SignatureUrl)
+		if err != nil {
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = shipmentReportTmpl.Execute(w, report)
+}
+
+// proofDataUrl inlines a proof file in a data url, so that the report needs no authentication.
+func proofDataUrl(ctx context.Context, url string) (template.URL, error) {
+	if url == "" {
+		return "", nil
+	}
+	data, contentType, err := podStore.Get(ctx, strings.TrimPrefix(url, proofUrlPrefix))
+	if err != nil {
+		return "", err
+	}
+	return template.URL("data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data)), nil
+}
+
+var shipmentReportTmpl = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="UTF-8">
+<title>Consegna {{.Ship.Id}}</title>
+<style>
+	body {
+		padding: 10px;
+		font-family: sans-serif;
+	}
+	td {
+		padding: 4px 10px;
+	}
+	img {
+		max-width: 400px;
+		display: block;
+		margin-bottom: 10px;
+	}
+</style>
+</head>
+
+<body>
+{{with .Ship.Data}}
+<h1>Consegna {{$.Ship.Id}}</h1>
+<table>
+	<tr><td>Destinatario/contatti/note</td><td>{{.Notes}}</td></tr>
+	<tr><td>Indirizzo di ritiro</td><td>{{.PickupAddress}}</td></tr>
+	<tr><td>Indirizzo di consegna</td><td>{{.DeliveryAddress}}</td></tr>
+	<tr><td>Rider</td><td>{{.RiderName}}</td></tr>
+	<tr><td>Giorno</td><td>{{.ShipmentDay}}</td></tr>
+	<tr><td>Stato</td><td>{{.DeliveryStatus}}</td></tr>
+	{{if .PickedUpAt}}<tr><td>Ritirato</td><td>{{.PickedUpAt}}</td></tr>{{end}}
+	{{if .DeliveredAt}}<tr><td>Consegnato</td><td>{{.DeliveredAt}}</td></tr>{{end}}
+	{{if .FailedAt}}<tr><td>Fallito</td><td>{{.FailedAt}}: {{.FailureReason}}</td></tr>{{end}}
+	{{if .CanceledAt}}<tr><td>Annullato</td><td>{{.CanceledAt}}</td></tr>{{end}}
+	{{with .Proof}}<tr><td>Ricevuto da</td><td>{{.RecipientName}}, {{.RecordedAt}}</td></tr>{{end}}
+</table>
+{{end}}
+{{if .Photo}}<h2>Foto</h2><img src="{{.Photo}}">{{end}}
+{{if .Signature}}<h2>Firma</h2><img src="{{.Signature}}">{{end}}
+</body>
+
+</html>
+`))
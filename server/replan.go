@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/robzan8/taac/shipments"
+	"github.com/robzan8/taac/vrp"
+)
+
+func replanEndpoint(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		replanGet(w, req)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unsupported method %s", req.Method)
+	}
+}
+
+// replanGet updates the already written schedule of a day: canceled shipments
+// are dropped from the routes and pending ones are inserted, leaving alone
+// the stops that have already started or been completed.
+// Like scheduleGet, it supports dryRun.
+func replanGet(w http.ResponseWriter, req *http.Request) {
+	authHeader, claims, ok := authenticate(w, req)
+	if !ok {
+		return
+	}
+
+	var err error // beware of shadowing
+	defer func() {
+		if err != nil {
+			w.WriteHeader(errorStatus(err))
+			fmt.Fprintf(w, "%s", err)
+		}
+	}()
+
+	schedDate := req.FormValue("date")
+	if !dateRegex.MatchString(schedDate) {
+		err = fmt.Errorf("date must be in the format 2022-12-31")
+		return
+	}
+	unlock, busy := lockSchedule(claims.organization(), []string{schedDate})
+	if unlock == nil {
+		writeScheduleInProgress(w, busy)
+		return
+	}
+	defer unlock()
+	dryRun := req.FormValue("dryRun") == "true"
+	policy, err := riderPolicyFromRequest(req)
+	if err != nil {
+		return
+	}
+	riderData, err := backend.Riders(req.Context(), authHeader)
+	if err != nil {
+		return
+	}
+	shipData, err := backend.Shipments(req.Context(), authHeader)
+	if err != nil {
+		return
+	}
+
+	plan, err := planReplan(req.Context(), riderData, shipData, schedDate, policy, time.Now())
+	if err == errNoRiders || err == errNoShipments {
+		fmt.Fprint(w, err)
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	if len(plan.Ships) == 0 {
+		fmt.Fprint(w, "The schedule is already up to date")
+		return
+	}
+	err = applyPlan(req.Context(), w, authHeader, claims, plan, dryRun)
+}
+
+// planReplan re-optimizes the schedule of schedDate at time now.
+// Shipments that have been picked up, delivered or failed,
+// and those whose pickup time has passed, are fixed:
+// their rider starts again from the last of their deliveries.
+// The other scheduled shipments stay with their rider, but may change order and times.
+// Only the shipments whose data changes end up in the plan.
+func planReplan(ctx context.Context, riders []shipments.Rider, shipData []shipments.Shipment, schedDate string, policy riderPolicy, now time.Time) (*schedulePlan, error) {
+	fingerprint := dataFingerprint(riders, shipData)
+
+	type stop struct {
+		time int64
+		addr string
+	}
+	lastFixed := make(map[string]stop) // by rider name
+	var movable []shipments.Shipment
+	for _, s := range shipData {
+		if s.Data.ShipmentDay != schedDate || s.Data.RiderName == "" {
+			continue
+		}
+		fixed := false
+		switch s.Data.DeliveryStatus {
+		case shipments.StatusPickedUp, shipments.StatusDelivered, shipments.StatusFailed:
+			fixed = true
+		case shipments.StatusScheduled:
+			t, err := unixTime(schedDate, s.Data.PickupTime)
+			fixed = err == nil && t <= now.Unix()
+		default:
+			continue // canceled
+		}
+		if !fixed {
+			movable = append(movable, s)
+			continue
+		}
+		if _, ok := lastFixed[s.Data.RiderName]; !ok {
+			lastFixed[s.Data.RiderName] = stop{}
+		}
+		t, err := unixTime(schedDate, s.Data.DeliveryTime)
+		if err == nil && t > lastFixed[s.Data.RiderName].time {
+			lastFixed[s.Data.RiderName] = stop{t, s.Data.DeliveryAddress}
+		}
+	}
+	shipsCopy := make([]shipments.Shipment, len(shipData))
+	copy(shipsCopy, shipData)
+	pending := shipmentsToBeScheduled(shipsCopy)
+	if len(movable) == 0 && len(pending) == 0 {
+		return nil, errNoShipments
+	}
+
+	// The riders already working on the day, plus others if there is room.
+	working := make(map[string]bool)
+	for _, s := range movable {
+		working[s.Data.RiderName] = true
+	}
+	for name := range lastFixed {
+		working[name] = true
+	}
+	var selected []shipments.Rider
+	for _, r := range riders {
+		if working[r.Data.Name] {
+			selected = append(selected, r)
+		}
+	}
+	if policy.MaxRiders > len(selected) {
+		policy.MaxRiders -= len(selected)
+		selected = append(selected, availableRiders(riders, schedDate, shipData, policy)...)
+	}
+
+	var vehicles []vrp.Vehicle
+	var dayStart int64 // of the shifts, before moving the starts to now
+	for _, r := range selected {
+		v, err := planner.Vehicle(ctx, r, schedDate)
+		if err != nil {
+			return nil, err
+		}
+		if dayStart == 0 || v.EarliestStart < dayStart {
+			dayStart = v.EarliestStart
+		}
+		if last, ok := lastFixed[r.Data.Name]; ok && last.addr != "" {
+			v.StartAddress.Str = last.addr
+			v.StartAddress.Lat, v.StartAddress.Lon, err = geocoder.Geocode(ctx, last.addr)
+			if err != nil {
+				return nil, err
+			}
+			if last.time > v.EarliestStart {
+				v.EarliestStart = last.time
+			}
+		}
+		if now.Unix() > v.EarliestStart {
+			v.EarliestStart = now.Unix()
+		}
+		if v.EarliestStart < v.LatestEnd {
+			vehicles = append(vehicles, v)
+		}
+	}
+	if len(vehicles) == 0 {
+		return nil, errNoRiders
+	}
+
+	var ships []vrp.Shipment
+	for _, data := range movable {
+		s, err := planner.Shipment(ctx, data, schedDate, dayStart)
+		if err != nil {
+			return nil, err
+		}
+		s.Priority = 1
+		s.AllowedVehicles = []string{data.Data.RiderName}
+		ships = append(ships, s)
+	}
+	priority := 2
+	for i, data := range pending {
+		s, err := planner.Shipment(ctx, data, schedDate, dayStart)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 && priority < 10 && data.Data.Deadline != pending[i-1].Data.Deadline {
+			priority++
+		}
+		s.Priority = priority
+		ships = append(ships, s)
+	}
+	solution, err := solver.Solve(ctx, vrp.Problem{
+		Vehicles:     vehicles,
+		VehicleTypes: planner.VehicleTypes,
+		Shipments:    ships,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Movable shipments left out of the solution go back to be scheduled.
+	candidates := append(append([]shipments.Shipment(nil), movable...), pending...)
+	for i := range candidates {
+		d := &candidates[i].Data
+		d.DeliveryStatus = shipments.StatusToBeScheduled
+		d.RiderName, d.ShipmentDay, d.PickupTime, d.DeliveryTime = "", "", "", ""
+		d.RouteKm = 0
+	}
+	planner.WriteSolution(candidates, solution, schedDate)
+
+	plan := &schedulePlan{
+		Fingerprint: fingerprint,
+		Days:        []dayPlan{{schedDate, solution}},
+	}
+	for i, s := range candidates {
+		if s.Data.DeliveryStatus != shipments.StatusScheduled {
+			plan.Unassigned = append(plan.Unassigned, s)
+		}
+		if i < len(movable) && sameData(s, movable[i]) {
+			continue
+		}
+		if i >= len(movable) && s.Data.DeliveryStatus != shipments.StatusScheduled {
+			continue // still pending
+		}
+		plan.Ships = append(plan.Ships, s)
+	}
+	plan.Versions = shipmentVersions(plan.Ships, shipData)
+	return plan, nil
+}
+
+func sameData(a, b shipments.Shipment) bool {
+	ja, errA := json.Marshal(a.Data)
+	jb, errB := json.Marshal(b.Data)
+	return errA == nil && errB == nil && string(ja) == string(jb)
+}
@@ -1,297 +1,523 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
 	"sort"
-	"strings"
-	"sync"
-)
-
-type shipmentData struct {
-	Id     string `json:"id"`
-	User   string `json:"user_data_ref_id"`
-	Schema string `json:"schema_id"`
-	Data   struct {
-		Size               int    `json:"size"`
-		PickupAddress      string `json:"pickup_address"`
-		DeliveryAddress    string `json:"delivery_address"`
-		Notes              string `json:"notes"`
-		Deadline           string `json:"deadline,omitempty"`
-		LatestDeliveryTime string `json:"latest_delivery_time"`
-
-		RiderName      string `json:"rider_name"`
-		ShipmentDay    string `json:"shipment_day,omitempty"`
-		PickupTime     string `json:"pickup_time"`
-		DeliveryTime   string `json:"delivery_time"`
-		DeliveryStatus string `json:"delivery_status"`
-	} `json:"data"`
-}
+	"strconv"
+	"time"
 
-const (
-	deliveryStatusToBeScheduled = "to_be_scheduled"
-	deliveryStatusScheduled     = "scheduled"
-	deliveryStatusDelivered     = "delivered"
-	deliveryStatusCanceled      = "canceled"
+	"github.com/robzan8/taac/shipments"
+	"github.com/robzan8/taac/vrp"
 )
 
-type riderData struct {
-	Id   string `json:"id"`
-	Data struct {
-		Name          string `json:"name"`
-		VehicleTypeId string `json:"vehicle_type_id"`
-		StartAddress  string `json:"start_address"`
-		EarliestStart string `json:"earliest_start"`
-		LatestEnd     string `json:"latest_end"`
-	} `json:"data"`
-}
-
-const graphqlUrl = "https://apfybdlkrpoqwnxchjgg.nhost.run/v1/graphql"
-
-var scheduleMu sync.Mutex
-
 func scheduleEndpoint(w http.ResponseWriter, req *http.Request) {
-	setAllowOrigins(w.Header())
-
 	switch req.Method {
-	case http.MethodOptions:
-		// OK
 	case http.MethodGet:
 		scheduleGet(w, req)
+	case http.MethodPost:
+		schedulePost(w, req)
 	default:
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "Unsupported method %s", req.Method)
 	}
 }
 
+func writeScheduleInProgress(w http.ResponseWriter, day string) {
+	w.WriteHeader(http.StatusConflict)
+	fmt.Fprintf(w, "A schedule of %s is already in progress, try again when it is done", day)
+}
+
+// authenticate verifies the bearer token of req and returns the header
+// to be forwarded to nhost, so that it applies its permissions too.
+// On failure, it writes the error to w and returns ok == false.
+func authenticate(w http.ResponseWriter, req *http.Request) (authHeader string, claims hasuraClaims, ok bool) {
+	authToken, err := bearerToken(req)
+	if err == nil {
+		claims, err = verifyToken(req.Context(), authToken)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "%s", err)
+		return "", claims, false
+	}
+	return "Bearer " + authToken, claims, true
+}
+
+// scheduleGet computes the schedule for the given date, or for the days from..to,
+// and writes it to the database. With dryRun=true, the schedule is only stored as a plan and previewed,
+// it can then be applied by POSTing its planId.
 func scheduleGet(w http.ResponseWriter, req *http.Request) {
-	scheduleMu.Lock()
+	authHeader, claims, ok := authenticate(w, req)
+	if !ok {
+		return
+	}
+
 	var err error // beware of shadowing
 	defer func() {
 		if err != nil {
-			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.WriteHeader(errorStatus(err))
 			fmt.Fprintf(w, "%s", err)
 		}
-		scheduleMu.Unlock()
 	}()
 
-	schedDate := req.FormValue("date")
-	if !dateRegex.MatchString(schedDate) {
-		err = fmt.Errorf("date must be in the format 2022-12-31")
+	from, to, err := scheduleRange(req)
+	if err != nil {
 		return
 	}
-	authToken := req.FormValue("authToken")
-	if authToken == "" {
-		err = errors.New("No authToken provided")
+	var days []string
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		days = append(days, d.Format(dateLayout))
+	}
+	unlock, busy := lockSchedule(claims.organization(), days)
+	if unlock == nil {
+		writeScheduleInProgress(w, busy)
+		return
+	}
+	defer unlock()
+	dryRun := req.FormValue("dryRun") == "true"
+	policy, err := riderPolicyFromRequest(req)
+	if err != nil {
 		return
 	}
-	authHeader := "Bearer " + authToken
-	riderData, err := getRiderData(authHeader)
+	riderData, err := backend.Riders(req.Context(), authHeader)
 	if err != nil {
 		return
 	}
-	shipData, err := getShipmentData(authHeader)
+	shipData, err := backend.Shipments(req.Context(), authHeader)
 	if err != nil {
 		return
 	}
 
-	availRiders := availableRiders(riderData, schedDate, shipData)
-	if len(availRiders) == 0 {
-		fmt.Fprint(w, "No rider available for the target day")
+	plan, err := planScheduleRange(req.Context(), riderData, shipData, from, to, policy)
+	if err == errNoRiders || err == errNoShipments {
+		fmt.Fprint(w, err)
+		err = nil
 		return
 	}
-	shipsToBeSched := shipmentsToBeScheduled(shipData, availRiders)
-	if len(shipsToBeSched) == 0 {
-		fmt.Fprint(w, "No shipment to be scheduled")
+	if err != nil {
 		return
 	}
+	err = applyPlan(req.Context(), w, authHeader, claims, plan, dryRun)
+}
 
-	var vehicles []Vehicle
-	for _, r := range availRiders {
-		var v Vehicle
-		v, err = riderToVehicle(r)
-		if err != nil {
-			return
+// applyPlan writes the shipments of plan to the database. With dryRun,
+// it instead stores the plan for a later commit and writes a preview of it.
+func applyPlan(ctx context.Context, w io.Writer, authHeader string, claims hasuraClaims, plan *schedulePlan, dryRun bool) error {
+	if dryRun {
+		plan.UserId = claims.UserId
+		storePlan(plan)
+		writePlanPreview(w, plan)
+		return nil
+	}
+	return commitPlan(ctx, w, authHeader, claims.organization(), plan)
+}
+
+// commitPlan writes the shipments of plan to the database,
+// notifies their recipients and fires the webhook events of org.
+func commitPlan(ctx context.Context, w io.Writer, authHeader, org string, plan *schedulePlan) error {
+	err := writeShipments(ctx, authHeader, plan.Ships, plan.Versions)
+	if err != nil {
+		return err
+	}
+	notifyShipments(plan.Ships)
+	var assigned []shipments.Shipment
+	for _, s := range plan.Ships {
+		if s.Data.DeliveryStatus == shipments.StatusScheduled {
+			assigned = append(assigned, s)
+			fireEvent(org, eventShipmentAssigned, s)
 		}
-		vehicles = append(vehicles, v)
 	}
-	var ships []Shipment
-	priority := 1
-	for i, data := range shipsToBeSched {
-		var s Shipment
-		s, err = dataToShipment(data)
+	fireEvent(org, eventScheduleCommitted, map[string]interface{}{"shipments": assigned})
+	writeScheduledShipments(w, plan)
+	return nil
+}
+
+// schedulePost applies a plan previously previewed with dryRun,
+// provided that riders and shipments have not changed in the meantime.
+func schedulePost(w http.ResponseWriter, req *http.Request) {
+	authHeader, claims, ok := authenticate(w, req)
+	if !ok {
+		return
+	}
+
+	var err error // beware of shadowing
+	defer func() {
 		if err != nil {
-			return
-		}
-		if i > 0 && priority < 10 && data.Data.Deadline != shipsToBeSched[i-1].Data.Deadline {
-			priority++
+			w.WriteHeader(errorStatus(err))
+			fmt.Fprintf(w, "%s", err)
 		}
-		s.Priority = priority
-		ships = append(ships, s)
+	}()
+
+	plan := loadPlan(req.FormValue("planId"))
+	if plan == nil || plan.UserId != claims.UserId {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Plan not found or expired")
+		return
+	}
+	var days []string
+	for _, d := range plan.Days {
+		days = append(days, d.Date)
+	}
+	unlock, busy := lockSchedule(claims.organization(), days)
+	if unlock == nil {
+		writeScheduleInProgress(w, busy)
+		return
+	}
+	defer unlock()
+	riderData, err := backend.Riders(req.Context(), authHeader)
+	if err != nil {
+		return
 	}
-	problem := CreateProblem(vehicles, ships)
-	solution, err := Solve(problem)
+	shipData, err := backend.Shipments(req.Context(), authHeader)
 	if err != nil {
 		return
 	}
+	if dataFingerprint(riderData, shipData) != plan.Fingerprint {
+		deletePlan(plan.Id)
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, "Riders or shipments changed since the plan was computed, compute a new one")
+		return
+	}
+	err = commitPlan(req.Context(), w, authHeader, claims.organization(), plan)
+	if err != nil {
+		return
+	}
+	deletePlan(plan.Id)
+}
 
-	writeSolutionIntoShipments(shipsToBeSched, solution, schedDate)
-	var schedShips []shipmentData
-	for _, s := range shipsToBeSched {
-		if s.Data.DeliveryStatus == deliveryStatusScheduled {
-			schedShips = append(schedShips, s)
+// riderPolicyFromRequest reads the optional maxRiders and seed parameters.
+// With a seed, riders with the same load are picked at random; without,
+// by rider id, see riderPolicy.
+func riderPolicyFromRequest(req *http.Request) (riderPolicy, error) {
+	policy := riderPolicy{MaxRiders: conf.Schedule.MaxRidersPerDay}
+	if s := req.FormValue("maxRiders"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return policy, errors.New("maxRiders must be a positive integer")
+		}
+		policy.MaxRiders = n
+	}
+	if s := req.FormValue("seed"); s != "" {
+		seed, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return policy, errors.New("seed must be an integer")
+		}
+		policy.Rand = rand.New(rand.NewSource(seed))
+	}
+	return policy, nil
+}
+
+// scheduleRange reads either the date parameter or the from and to parameters.
+func scheduleRange(req *http.Request) (from, to time.Time, err error) {
+	if date := req.FormValue("date"); date != "" || req.FormValue("from") == "" {
+		if !dateRegex.MatchString(date) {
+			err = fmt.Errorf("date must be in the format 2022-12-31")
+			return
 		}
+		from, err = time.Parse(dateLayout, date)
+		return from, from, err
 	}
-	err = updateShipmentData(authHeader, schedShips)
+	fromStr, toStr := req.FormValue("from"), req.FormValue("to")
+	if !dateRegex.MatchString(fromStr) || !dateRegex.MatchString(toStr) {
+		err = fmt.Errorf("from and to must be in the format 2022-12-31")
+		return
+	}
+	from, err = time.Parse(dateLayout, fromStr)
 	if err != nil {
 		return
 	}
-	fmt.Fprint(w, "The following shipments have been scheduled:")
-	for _, s := range schedShips {
-		fmt.Fprint(w, "\n"+s.Id)
+	to, err = time.Parse(dateLayout, toStr)
+	if err != nil {
+		return
+	}
+	if to.Before(from) || to.Sub(from) >= time.Duration(conf.Schedule.MaxDays)*24*time.Hour {
+		err = fmt.Errorf("to must be after from and at most %d days apart", conf.Schedule.MaxDays-1)
 	}
+	return
 }
 
-type QueryErrors struct {
-	Errors []struct {
-		Message string `json:"message"`
-	} `json:"errors"`
+var (
+	errNoRiders    = errors.New("No rider available for the target days")
+	errNoShipments = errors.New("No shipment to be scheduled")
+)
+
+// planScheduleRange plans the days from..to in order without touching the database.
+// Shipments go to the solver of each day with a priority from the days they can
+// still wait before their deadline, see deadlinePriority, so that the riders of a day
+// serve first the shipments that have no later chance; what is left over is carried
+// to the following day. Missed deadlines are reported once all the days are planned.
+func planScheduleRange(ctx context.Context, riderData []shipments.Rider, shipData []shipments.Shipment, from, to time.Time, policy riderPolicy) (*schedulePlan, error) {
+	plan := &schedulePlan{Fingerprint: dataFingerprint(riderData, shipData)}
+	ships := make([]shipments.Shipment, len(shipData))
+	copy(ships, shipData)
+	pending := shipmentsToBeScheduled(ships)
+	if len(pending) == 0 {
+		return nil, errNoShipments
+	}
+
+	var workDays []string
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		for _, r := range riderData {
+			if r.AvailableOn(d.Weekday()) {
+				workDays = append(workDays, d.Format(dateLayout))
+				break
+			}
+		}
+	}
+	for d := range workDays {
+		day, err := planSchedule(ctx, riderData, ships, workDays[d:], policy)
+		if err == errNoRiders {
+			continue
+		}
+		if err == errNoShipments {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		plan.Days = append(plan.Days, day.Days...)
+		plan.Ships = append(plan.Ships, day.Ships...)
+		// The next days must see these as scheduled.
+		scheduled := make(map[string]shipments.Shipment)
+		for _, s := range day.Ships {
+			scheduled[s.Id] = s
+		}
+		for i, s := range ships {
+			if sched, ok := scheduled[s.Id]; ok {
+				ships[i] = sched
+			}
+		}
+	}
+	if len(plan.Days) == 0 {
+		return nil, errNoRiders
+	}
+
+	scheduled := make(map[string]bool)
+	for _, s := range plan.Ships {
+		scheduled[s.Id] = true
+		if s.Data.Deadline != "" && s.Data.ShipmentDay > s.Data.Deadline {
+			plan.Late = append(plan.Late, s)
+		}
+	}
+	plan.Versions = shipmentVersions(plan.Ships, shipData)
+	lastDay := to.Format(dateLayout)
+	for _, s := range pending {
+		if scheduled[s.Id] {
+			continue
+		}
+		plan.Unassigned = append(plan.Unassigned, s)
+		if s.Data.Deadline != "" && s.Data.Deadline <= lastDay {
+			plan.Late = append(plan.Late, s)
+		}
+	}
+	return plan, nil
 }
 
-func queryAndDecode(authHeader, query string, vars map[string]interface{}, dest interface{}) error {
-	varsJson := []byte("{}")
-	if len(vars) > 0 {
-		var err error
-		varsJson, err = json.Marshal(vars)
+// planSchedule computes the schedule for workDays[0], the others being the following
+// days of the range on which riders work. It reorders shipData.
+func planSchedule(ctx context.Context, riderData []shipments.Rider, shipData []shipments.Shipment, workDays []string, policy riderPolicy) (plan *schedulePlan, err error) {
+	schedDate := workDays[0]
+	availRiders := availableRiders(riderData, schedDate, shipData, policy)
+	if len(availRiders) == 0 {
+		return nil, errNoRiders
+	}
+	shipsToBeSched := shipmentsToBeScheduled(shipData)
+	if len(shipsToBeSched) == 0 {
+		return nil, errNoShipments
+	}
+
+	var vehicles []vrp.Vehicle
+	for _, r := range availRiders {
+		var v vrp.Vehicle
+		v, err = planner.Vehicle(ctx, r, schedDate)
 		if err != nil {
-			return err
+			return
 		}
+		vehicles = append(vehicles, v)
 	}
-	reqBody := fmt.Sprintf(`{"query":%q,"variables":%s}`, query, varsJson)
-	req, err := http.NewRequest(http.MethodPost, graphqlUrl, strings.NewReader(reqBody))
-	if err != nil {
-		return err
+	dayStart := shipments.DayStart(vehicles)
+	var ships []vrp.Shipment
+	for _, data := range shipsToBeSched {
+		var s vrp.Shipment
+		s, err = planner.Shipment(ctx, data, schedDate, dayStart)
+		if err != nil {
+			return
+		}
+		s.Priority = deadlinePriority(data, workDays)
+		ships = append(ships, s)
 	}
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Authorization", authHeader)
-	resp, err := http.DefaultClient.Do(req)
+	solution, err := solver.Solve(ctx, vrp.Problem{
+		Vehicles:     vehicles,
+		VehicleTypes: planner.VehicleTypes,
+		Shipments:    ships,
+	})
 	if err != nil {
-		return err
+		return
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Graphql query not ok, status: %d", resp.StatusCode)
+
+	planner.WriteSolution(shipsToBeSched, solution, schedDate)
+	plan = &schedulePlan{
+		Days: []dayPlan{{schedDate, solution}},
+	}
+	for _, s := range shipsToBeSched {
+		if s.Data.DeliveryStatus == shipments.StatusScheduled {
+			plan.Ships = append(plan.Ships, s)
+		} else {
+			plan.Unassigned = append(plan.Unassigned, s)
+		}
 	}
-	return json.NewDecoder(resp.Body).Decode(dest)
+	return plan, nil
 }
 
-func getRiderData(authHeader string) ([]riderData, error) {
-	const query = `{
-		form_data(
-			where: {_and:[
-				{schema_id:{_eq:"4b627641-62ff-4a18-99ca-6724acfdbcb7"}},
-				{is_deleted:{_eq:false}}
-			]},
-			limit: 50
-		)
-		{id data}
-	}`
-	var msg struct {
-		QueryErrors
-		Data struct {
-			RiderData []riderData `json:"form_data"`
-		} `json:"data"`
-	}
-	err := queryAndDecode(authHeader, query, nil, &msg)
-	if err != nil {
-		return nil, err
+// deadlinePriority returns the solver priority of s on workDays[0]: the number of
+// workDays on which s can still be delivered in time, plus one if it may also wait
+// after them, from 1, the highest, for a shipment that has no later chance
+// (or whose deadline is past), to 10. Shipments without deadline can wait the longest.
+func deadlinePriority(s shipments.Shipment, workDays []string) int {
+	deadline := s.Data.Deadline
+	chances := 0
+	for _, d := range workDays {
+		if deadline != "" && d > deadline {
+			break
+		}
+		chances++
 	}
-	if len(msg.Errors) > 0 {
-		return nil, errors.New(msg.Errors[0].Message)
+	if deadline == "" || deadline > workDays[len(workDays)-1] {
+		chances++
 	}
-	return msg.Data.RiderData, nil
+	switch {
+	case chances < 1:
+		return 1
+	case chances > 10:
+		return 10
+	}
+	return chances
 }
 
-func getShipmentData(authHeader string) ([]shipmentData, error) {
-	const query = `{
-		form_data(
-			where: {_and:[
-				{schema_id:{_eq:"46cceffa-3f83-4d60-bb13-0767299a8352"}},
-				{is_deleted:{_eq:false}}
-			]},
-			order_by: [{created_at: desc}],
-			limit: 500
-		)
-		{id data}
-	}`
-	var msg struct {
-		QueryErrors
-		Data struct {
-			ShipData []shipmentData `json:"form_data"`
-		} `json:"data"`
-	}
-	err := queryAndDecode(authHeader, query, nil, &msg)
-	if err != nil {
-		return nil, err
+func writeScheduledShipments(w io.Writer, plan *schedulePlan) {
+	fmt.Fprint(w, "The following shipments have been scheduled:")
+	var unscheduled []shipments.Shipment
+	for _, s := range plan.Ships {
+		if s.Data.DeliveryStatus != shipments.StatusScheduled {
+			unscheduled = append(unscheduled, s)
+			continue
+		}
+		fmt.Fprint(w, "\n"+s.Id+" on "+s.Data.ShipmentDay)
 	}
-	if len(msg.Errors) > 0 {
-		return nil, errors.New(msg.Errors[0].Message)
+	if len(unscheduled) > 0 {
+		fmt.Fprint(w, "\n\nThe following shipments have been taken out of the schedule:")
+		for _, s := range unscheduled {
+			fmt.Fprint(w, "\n"+s.Id)
+		}
 	}
-	return msg.Data.ShipData, nil
+	writeLateShipments(w, plan)
 }
 
-func updateShipmentData(authHeader string, ships []shipmentData) error {
-	const query = `mutation($shipments: [form_data_insert_input]!) {
-		insert_form_data(
-			objects: $shipments,
-			on_conflict: {
-				constraint: form_data_pkey,
-				update_columns: [data]
+// writePlanPreview writes the stops of each rider in order for every day,
+// followed by the unassigned shipments.
+func writePlanPreview(w io.Writer, plan *schedulePlan) {
+	fmt.Fprintf(w, "Plan %s (not yet applied)\n", plan.Id)
+	for _, day := range plan.Days {
+		for _, route := range day.Solution.Solution.Routes {
+			fmt.Fprintf(w, "\n%s, rider %s:\n", day.Date, route.VehicleId)
+			for _, act := range route.Activities {
+				t := act.ArrivalTime
+				if t == 0 {
+					t = act.EndTime
+				}
+				switch act.Type {
+				case vrp.ActivityTypePickup:
+					fmt.Fprintf(w, "%s pickup   %s at %s\n", formatHourMin(t), act.ShipmentId, act.Address.Str)
+				case vrp.ActivityTypeDeliver:
+					fmt.Fprintf(w, "%s delivery %s at %s\n", formatHourMin(t), act.ShipmentId, act.Address.Str)
+				}
 			}
-		)
-		{
-			affected_rows
 		}
-	}`
-	vars := map[string]interface{}{"shipments": ships}
-	var msg QueryErrors
-	err := queryAndDecode(authHeader, query, vars, &msg)
-	if err != nil {
-		return err
 	}
-	if len(msg.Errors) > 0 {
-		return errors.New(msg.Errors[0].Message)
+	if len(plan.Unassigned) > 0 {
+		fmt.Fprint(w, "\nUnassigned:\n")
+		for _, s := range plan.Unassigned {
+			fmt.Fprintf(w, "%s to %s\n", s.Id, s.Data.DeliveryAddress)
+		}
 	}
-	return nil
+	writeLateShipments(w, plan)
+}
+
+func writeLateShipments(w io.Writer, plan *schedulePlan) {
+	if len(plan.Late) == 0 {
+		return
+	}
+	fmt.Fprint(w, "\n\nThe deadline of the following shipments cannot be met:")
+	for _, s := range plan.Late {
+		day := s.Data.ShipmentDay
+		if day == "" {
+			day = "not scheduled"
+		}
+		fmt.Fprintf(w, "\n%s, deadline %s, %s", s.Id, s.Data.Deadline, day)
+	}
+}
+
+// riderPolicy controls which riders are selected for a day.
+type riderPolicy struct {
+	MaxRiders int
+	// With a nil Rand, ties between equally loaded riders are broken by rider id,
+	// so the same inputs always give the same selection.
+	Rand *rand.Rand
 }
 
-func availableRiders(riders []riderData, day string, ships []shipmentData) []riderData {
+// availableRiders selects at most policy.MaxRiders riders that declared to be available
+// on the weekday of day and have no shipment on that day yet.
+// Riders with fewer deliveries in the week of day come first.
+func availableRiders(riders []shipments.Rider, day string, ships []shipments.Shipment, policy riderPolicy) []shipments.Rider {
+	date, err := time.Parse(dateLayout, day)
+	if err != nil {
+		return nil
+	}
+	year, week := date.ISOWeek()
 	busyRiders := make(map[string]bool)
+	weekLoad := make(map[string]int)
 	for _, s := range ships {
 		if s.Data.ShipmentDay == day {
 			busyRiders[s.Data.RiderName] = true
 		}
+		d, err := time.Parse(dateLayout, s.Data.ShipmentDay)
+		if err != nil || s.Data.RiderName == "" {
+			continue
+		}
+		if y, w := d.ISOWeek(); y == year && w == week {
+			weekLoad[s.Data.RiderName]++
+		}
 	}
-	rand.Shuffle(len(riders), func(i, j int) {
-		riders[i], riders[j] = riders[j], riders[i]
-	})
-	const maxNumRiders = 2
-	var selected []riderData
+
+	var candidates []shipments.Rider
 	for _, r := range riders {
-		if !busyRiders[r.Data.Name] {
-			selected = append(selected, r)
-			if len(selected) == maxNumRiders {
-				break
-			}
+		if !busyRiders[r.Data.Name] && r.AvailableOn(date.Weekday()) {
+			candidates = append(candidates, r)
 		}
 	}
-	return selected
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Id < candidates[j].Id
+	})
+	if policy.Rand != nil {
+		policy.Rand.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return weekLoad[candidates[i].Data.Name] < weekLoad[candidates[j].Data.Name]
+	})
+	if len(candidates) > policy.MaxRiders {
+		candidates = candidates[:policy.MaxRiders]
+	}
+	return candidates
 }
 
-func shipmentsToBeScheduled(ships []shipmentData, availRiders []riderData) []shipmentData {
+func shipmentsToBeScheduled(ships []shipments.Shipment) []shipments.Shipment {
 	sort.Slice(ships, func(i, j int) bool {
 		deadlineI := ships[i].Data.Deadline
 		deadlineJ := ships[j].Data.Deadline
@@ -304,114 +530,11 @@ func shipmentsToBeScheduled(ships []shipmentData, availRiders []riderData) []shi
 		return deadlineI < deadlineJ
 	})
 
-	locations := make(map[string]bool)
-	const maxNumLocs = 30
-	for _, r := range availRiders {
-		locations[r.Data.StartAddress] = true
-	}
-	var selected []shipmentData
+	var selected []shipments.Shipment
 	for _, s := range ships {
-		if s.Data.DeliveryStatus == "" || s.Data.DeliveryStatus == deliveryStatusToBeScheduled {
+		if s.Data.DeliveryStatus == "" || s.Data.DeliveryStatus == shipments.StatusToBeScheduled {
 			selected = append(selected, s)
-			locations[s.Data.PickupAddress] = true
-			locations[s.Data.DeliveryAddress] = true
-			if len(locations) >= maxNumLocs-1 {
-				break
-			}
 		}
 	}
 	return selected
 }
-
-func riderToVehicle(r riderData) (v Vehicle, err error) {
-	defer func() {
-		if err != nil {
-			err = fmt.Errorf("Error in rider %s: %s", r.Id, err)
-		}
-	}()
-	lat, lon, err := GeocodeAddress(r.Data.StartAddress)
-	if err != nil {
-		return
-	}
-	start, err := unixTime(r.Data.EarliestStart)
-	if err != nil {
-		return
-	}
-	end, err := unixTime(r.Data.LatestEnd)
-	if err != nil {
-		return
-	}
-	return Vehicle{
-		Id:            r.Data.Name,
-		Type:          r.Data.VehicleTypeId,
-		StartAddress:  Address{r.Data.StartAddress, lat, lon},
-		EarliestStart: start,
-		LatestEnd:     end,
-	}, nil
-}
-
-func dataToShipment(d shipmentData) (s Shipment, err error) {
-	defer func() {
-		if err != nil {
-			err = fmt.Errorf("Error in shipment %s: %s", d.Id, err)
-		}
-	}()
-	var (
-		pickupAddr   = Address{Str: d.Data.PickupAddress}
-		deliveryAddr = Address{Str: d.Data.DeliveryAddress}
-	)
-	pickupAddr.Lat, pickupAddr.Lon, err = GeocodeAddress(pickupAddr.Str)
-	if err != nil {
-		return
-	}
-	deliveryAddr.Lat, deliveryAddr.Lon, err = GeocodeAddress(deliveryAddr.Str)
-	if err != nil {
-		return
-	}
-	var deliveryTimeWindows []TimeWindow
-	if d.Data.LatestDeliveryTime != "" {
-		var t int64
-		t, err = unixTime(d.Data.LatestDeliveryTime)
-		if err != nil {
-			return
-		}
-		deliveryTimeWindows = []TimeWindow{{0, t}}
-	}
-	return Shipment{
-		Id:       d.Id,
-		Size:     [1]int{d.Data.Size},
-		Pickup:   Delivery{pickupAddr, PickupPrepTime, nil},
-		Delivery: Delivery{deliveryAddr, DeliveryPrepTime, deliveryTimeWindows},
-	}, nil
-}
-
-func writeSolutionIntoShipments(ships []shipmentData, sol Solution, schedDate string) {
-	shipsById := make(map[string]*shipmentData)
-	for i, s := range ships {
-		shipsById[s.Id] = &ships[i]
-	}
-	for _, route := range sol.Solution.Routes {
-		riderName := route.VehicleId
-		for _, act := range route.Activities {
-			switch act.Type {
-			case ActivityTypePickup:
-				ship := shipsById[act.ShipmentId]
-				ship.Data.DeliveryStatus = deliveryStatusScheduled
-				ship.Data.RiderName = riderName
-				ship.Data.ShipmentDay = schedDate
-				pickupTime := act.ArrivalTime
-				if pickupTime == 0 {
-					pickupTime = act.EndTime
-				}
-				ship.Data.PickupTime = formatHourMin(pickupTime)
-			case ActivityTypeDeliver:
-				ship := shipsById[act.ShipmentId]
-				deliveryTime := act.ArrivalTime
-				if deliveryTime == 0 {
-					deliveryTime = act.EndTime
-				}
-				ship.Data.DeliveryTime = formatHourMin(deliveryTime)
-			}
-		}
-	}
-}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robzan8/taac/fake"
+	"github.com/robzan8/taac/shipments"
+)
+
+var planIdRegex = regexp.MustCompile(`Plan ([0-9a-f]+) \(not yet applied\)`)
+
+// dryRun previews the schedule of date and returns the id of the plan.
+func dryRun(t *testing.T, s *fake.Services, date string) string {
+	t.Helper()
+	rec := do(t, s, httptest.NewRequest(http.MethodGet, "/schedule.txt?dryRun=true&date="+date, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("dry run: status %d: %s", rec.Code, rec.Body)
+	}
+	m := planIdRegex.FindStringSubmatch(rec.Body.String())
+	if m == nil {
+		t.Fatalf("dry run returned no plan:\n%s", rec.Body)
+	}
+	return m[1]
+}
+
+func testDate() string {
+	return time.Now().In(timeZone).AddDate(0, 0, 1).Format(dateLayout)
+}
+
+func TestScheduleDryRunThenCommit(t *testing.T) {
+	s := startFakes(t)
+	addRiders(t, s, "Anna", "Bob")
+	addShipments(t, s, "Via Po 2 Milano", "Corso Como 5 Milano", "Viale Monza 10 Milano")
+	date := testDate()
+
+	planId := dryRun(t, s, date)
+	ships, err := s.Backend.Shipments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sh := range ships {
+		if sh.Data.DeliveryStatus != shipments.StatusToBeScheduled {
+			t.Fatalf("dry run wrote shipment %s: %+v", sh.Id, sh.Data)
+		}
+	}
+
+	rec := do(t, s, httptest.NewRequest(http.MethodPost, "/schedule.txt?planId="+planId, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("commit: status %d: %s", rec.Code, rec.Body)
+	}
+	if !strings.HasPrefix(rec.Body.String(), "The following shipments have been scheduled") {
+		t.Errorf("commit returned:\n%s", rec.Body)
+	}
+	ships, err = s.Backend.Shipments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sh := range ships {
+		d := sh.Data
+		if d.DeliveryStatus != shipments.StatusScheduled || d.ShipmentDay != date ||
+			(d.RiderName != "Anna" && d.RiderName != "Bob") || d.PickupTime == "" || d.DeliveryTime == "" {
+			t.Errorf("shipment %s not scheduled on %s: %+v", sh.Id, date, d)
+		}
+		if d.RouteKm <= 0 {
+			t.Errorf("shipment %s has no share of the route: %+v", sh.Id, d)
+		}
+	}
+
+	rec = do(t, s, httptest.NewRequest(http.MethodPost, "/schedule.txt?planId="+planId, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("committing the plan again: status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestScheduleCommitAfterChange(t *testing.T) {
+	s := startFakes(t)
+	addRiders(t, s, "Anna")
+	addShipments(t, s, "Via Po 2 Milano", "Corso Como 5 Milano")
+	planId := dryRun(t, s, testDate())
+
+	ships, err := s.Backend.Shipments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ships[0].Data.Notes = "changed by someone else"
+	err = backend.UpdateShipments(context.Background(), "Bearer test", ships[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := do(t, s, httptest.NewRequest(http.MethodPost, "/schedule.txt?planId="+planId, nil))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("status %d, want %d: %s", rec.Code, http.StatusConflict, rec.Body)
+	}
+	after, err := s.Backend.Shipments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sh := range after {
+		if sh.Data.DeliveryStatus != shipments.StatusToBeScheduled {
+			t.Errorf("shipment %s written despite the conflict: %+v", sh.Id, sh.Data)
+		}
+	}
+}
+
+// A change between reading the shipments and writing them back
+// must not be overwritten, see writeShipments.
+func TestWriteShipmentsConcurrentChange(t *testing.T) {
+	s := startFakes(t)
+	addShipments(t, s, "Via Po 2 Milano", "Corso Como 5 Milano")
+	ctx := context.Background()
+	read, err := backend.Shipments(ctx, "Bearer test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := shipmentVersions(read, read)
+
+	concurrent := read[1]
+	concurrent.Data.DeliveryStatus = shipments.StatusCanceled
+	err = backend.UpdateShipments(ctx, "Bearer test", []shipments.Shipment{concurrent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := make([]shipments.Shipment, len(read))
+	copy(written, read)
+	for i := range written {
+		written[i].Data.RiderName = "Anna"
+	}
+	err = writeShipments(ctx, "Bearer test", written, versions)
+	if err != errShipmentsChanged || errorStatus(err) != http.StatusConflict {
+		t.Fatalf("got %v, want errShipmentsChanged", err)
+	}
+
+	after, err := s.Backend.Shipments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sh := range after {
+		if sh.Data.RiderName != "" {
+			t.Errorf("shipment %s written despite the conflict: %+v", sh.Id, sh.Data)
+		}
+		if sh.Id == concurrent.Id && sh.Data.DeliveryStatus != shipments.StatusCanceled {
+			t.Errorf("concurrent change of shipment %s lost: %+v", sh.Id, sh.Data)
+		}
+	}
+}
+
+// On Wednesday 2024-03-06, Anna already has a delivery in the week and Bob is not available.
+// The seeded selections are pinned: math/rand sources give the same sequence on every release.
+func TestAvailableRiders(t *testing.T) {
+	startFakes(t)
+	var riders []shipments.Rider
+	for i, name := range []string{"Anna", "Bob", "Carla", "Dario", "Elena"} {
+		var r shipments.Rider
+		r.Id = fmt.Sprint(i + 1)
+		r.Data.Name = name
+		riders = append(riders, r)
+	}
+	riders[1].Data.AvailableDays = []string{"mon"}
+	var monday shipments.Shipment
+	monday.Data.ShipmentDay = "2024-03-04"
+	monday.Data.RiderName = "Anna"
+	ships := []shipments.Shipment{monday}
+
+	for _, test := range []struct {
+		query string
+		want  string
+	}{
+		{"", "Carla Dario"},
+		{"maxRiders=4", "Carla Dario Elena Anna"},
+		{"seed=1", "Carla Elena"},
+		{"seed=3", "Elena Carla"},
+		{"seed=3&maxRiders=4", "Elena Carla Dario Anna"},
+	} {
+		policy, err := riderPolicyFromRequest(httptest.NewRequest(http.MethodGet, "/schedule.txt?"+test.query, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, r := range availableRiders(riders, "2024-03-06", ships, policy) {
+			names = append(names, r.Data.Name)
+		}
+		if got := strings.Join(names, " "); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.query, got, test.want)
+		}
+	}
+}
+
+// Past a tenth of the write timeout from its end, a plan is cut short, see withDeadline.
+func TestScheduleDeadline(t *testing.T) {
+	s := startFakes(t)
+	addRiders(t, s, "Anna")
+	addShipments(t, s, "Via Po 2 Milano")
+	dryRun(t, s, testDate()) // caches the JWKS
+
+	conf.Server.WriteTimeout = time.Nanosecond
+	rec := do(t, s, httptest.NewRequest(http.MethodGet, "/schedule.txt?date="+testDate(), nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("status %d, want %d: %s", rec.Code, http.StatusGatewayTimeout, rec.Body)
+	}
+}
+
+// Work days are Monday 2024-03-04, Tuesday and Thursday; Wednesday is skipped.
+func TestDeadlinePriority(t *testing.T) {
+	workDays := []string{"2024-03-04", "2024-03-05", "2024-03-07", "2024-03-08"}
+	for _, test := range []struct {
+		deadline string
+		want     int
+	}{
+		{"2024-03-01", 1}, // already past
+		{"2024-03-04", 1},
+		{"2024-03-05", 2},
+		{"2024-03-06", 2},
+		{"2024-03-07", 3},
+		{"2024-03-08", 4},
+		{"2024-03-11", 5}, // may also wait after the range
+		{"", 5},
+	} {
+		var s shipments.Shipment
+		s.Data.Deadline = test.deadline
+		if got := deadlinePriority(s, workDays); got != test.want {
+			t.Errorf("deadline %q: priority %d, want %d", test.deadline, got, test.want)
+		}
+	}
+
+	var longRange []string
+	for d := 1; d <= 20; d++ {
+		longRange = append(longRange, fmt.Sprintf("2024-04-%02d", d))
+	}
+	var s shipments.Shipment
+	if got := deadlinePriority(s, longRange); got != 10 {
+		t.Errorf("no deadline over 20 days: priority %d, want 10", got)
+	}
+}
+
+// Anna works on Monday 2024-03-04, Tuesday and Thursday, and has time for one
+// shipment a day: those due first must go first, and none on her days off.
+func TestPlanScheduleRange(t *testing.T) {
+	s := startFakes(t)
+	var anna shipments.Rider
+	anna.Data.Name = "Anna"
+	anna.Data.VehicleTypeId = conf.VehicleTypes[0].Id
+	anna.Data.StartAddress = "Piazza Duomo Milano"
+	anna.Data.EarliestStart = "09:00"
+	anna.Data.LatestEnd = "11:00"
+	anna.Data.AvailableDays = []string{"mon", "tue", "thu"}
+	err := s.Backend.AddRiders(testUser, anna)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadlines := map[string]string{ // by notes
+		"monday":      "2024-03-04",
+		"tuesday":     "2024-03-05",
+		"thursday":    "2024-03-07",
+		"no deadline": "",
+	}
+	for notes, deadline := range deadlines {
+		var sh shipments.Shipment
+		sh.Data.Notes = notes
+		sh.Data.Size = 10
+		sh.Data.PickupAddress = "Via Roma 1 Milano"
+		sh.Data.DeliveryAddress = "Via Po 2 Milano"
+		sh.Data.Deadline = deadline
+		sh.Data.DeliveryStatus = shipments.StatusToBeScheduled
+		err = s.Backend.AddShipments(testUser, sh)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+	riders, err := backend.Riders(ctx, "Bearer test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ships, err := backend.Shipments(ctx, "Bearer test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from, _ := time.Parse(dateLayout, "2024-03-04")
+	to, _ := time.Parse(dateLayout, "2024-03-08")
+	plan, err := planScheduleRange(ctx, riders, ships, from, to, riderPolicy{MaxRiders: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var days []string
+	for _, d := range plan.Days {
+		days = append(days, d.Date)
+	}
+	if got := strings.Join(days, " "); got != "2024-03-04 2024-03-05 2024-03-07" {
+		t.Errorf("planned days %s, want Monday, Tuesday and Thursday", got)
+	}
+	for _, sh := range plan.Ships {
+		if sh.Data.ShipmentDay != sh.Data.Deadline {
+			t.Errorf("%s planned on %s", sh.Data.Notes, sh.Data.ShipmentDay)
+		}
+	}
+	if len(plan.Ships) != 3 || len(plan.Unassigned) != 1 || plan.Unassigned[0].Data.Notes != "no deadline" || len(plan.Late) > 0 {
+		t.Errorf("planned %d, left %+v and %d late, want only the one without deadline left", len(plan.Ships), plan.Unassigned, len(plan.Late))
+	}
+}
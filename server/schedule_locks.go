@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/robzan8/taac/backend/graphql"
+	"github.com/robzan8/taac/shipments"
+)
+
+// The days being scheduled, by organization. Requests for other days
+// or other organizations proceed in parallel.
+var (
+	scheduleLocks   = make(map[scheduleKey]bool)
+	scheduleLocksMu sync.Mutex
+)
+
+type scheduleKey struct {
+	Org  string
+	Date string
+}
+
+// lockSchedule reserves the days of org for a scheduling request, all of them or none,
+// without waiting. If a day is already being scheduled, it returns it as busy.
+// Otherwise, the days must be released with unlock.
+func lockSchedule(org string, days []string) (unlock func(), busy string) {
+	scheduleLocksMu.Lock()
+	defer scheduleLocksMu.Unlock()
+
+	for _, d := range days {
+		if scheduleLocks[scheduleKey{org, d}] {
+			return nil, d
+		}
+	}
+	for _, d := range days {
+		scheduleLocks[scheduleKey{org, d}] = true
+	}
+	return func() {
+		scheduleLocksMu.Lock()
+		defer scheduleLocksMu.Unlock()
+
+		for _, d := range days {
+			delete(scheduleLocks, scheduleKey{org, d})
+		}
+	}, ""
+}
+
+// Shipments are read, changed and written back as a whole, so a write could
+// undo a concurrent one: they are written only if still as read, see writeShipments.
+var errShipmentsChanged = graphql.ErrChanged
+
+// shipmentVersions fingerprints the data of the shipments in ships as found in read.
+func shipmentVersions(ships, read []shipments.Shipment) map[string]string {
+	byId := make(map[string]shipments.Shipment)
+	for _, s := range read {
+		byId[s.Id] = s
+	}
+	versions := make(map[string]string)
+	for _, s := range ships {
+		versions[s.Id] = shipmentVersion(byId[s.Id])
+	}
+	return versions
+}
+
+func shipmentVersion(s shipments.Shipment) string {
+	data, _ := json.Marshal(s.Data)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeShipments writes ships to the database, provided that they are still
+// at the versions in versions. Otherwise it returns errShipmentsChanged.
+func writeShipments(ctx context.Context, authHeader string, ships []shipments.Shipment, versions map[string]string) error {
+	return backend.UpdateShipmentsIf(ctx, authHeader, ships, func(current shipments.Shipment) bool {
+		return shipmentVersion(current) == versions[current.Id]
+	})
+}
+
+// errorStatus is the HTTP status of a failed update, or of a plan cut short by withDeadline.
+func errorStatus(err error) int {
+	if err == errShipmentsChanged {
+		return http.StatusConflict
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusUnprocessableEntity
+}
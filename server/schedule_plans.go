@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/robzan8/taac/shipments"
+	"github.com/robzan8/taac/vrp"
+)
+
+// A schedulePlan is a computed schedule that has not been written to the database yet.
+type schedulePlan struct {
+	Id          string
+	UserId      string
+	Created     time.Time
+	Fingerprint string            // of the riders and shipments the plan was computed from
+	Versions    map[string]string // of the shipments in Ships, as read
+	Days        []dayPlan
+	Ships       []shipments.Shipment // scheduled, to be written back
+	Unassigned  []shipments.Shipment
+	Late        []shipments.Shipment // whose deadline cannot be met
+}
+
+type dayPlan struct {
+	Date     string
+	Solution vrp.Solution
+}
+
+var (
+	plans   = make(map[string]*schedulePlan)
+	plansMu sync.Mutex
+)
+
+func storePlan(plan *schedulePlan) {
+	plansMu.Lock()
+	defer plansMu.Unlock()
+
+	for id, p := range plans {
+		if time.Since(p.Created) > conf.Schedule.PlanTtl {
+			delete(plans, id)
+		}
+	}
+	plan.Id = randomId()
+	plan.Created = time.Now()
+	plans[plan.Id] = plan
+}
+
+// loadPlan returns nil if the plan doesn't exist or is expired.
+func loadPlan(id string) *schedulePlan {
+	plansMu.Lock()
+	defer plansMu.Unlock()
+
+	plan := plans[id]
+	if plan == nil || time.Since(plan.Created) > conf.Schedule.PlanTtl {
+		return nil
+	}
+	return plan
+}
+
+func deletePlan(id string) {
+	plansMu.Lock()
+	defer plansMu.Unlock()
+
+	delete(plans, id)
+}
+
+func dataFingerprint(riders []shipments.Rider, ships []shipments.Shipment) string {
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	enc.Encode(riders)
+	enc.Encode(ships)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/robzan8/taac/shipments"
+)
+
+// Allowed delivery status transitions, from -> to.
+var statusTransitions = map[string][]string{
+	shipments.StatusScheduled: {shipments.StatusPickedUp, shipments.StatusFailed, shipments.StatusCanceled},
+	shipments.StatusPickedUp:  {shipments.StatusDelivered, shipments.StatusFailed},
+}
+
+func statusEndpoint(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		statusPost(w, req)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unsupported method %s", req.Method)
+	}
+}
+
+// statusPost lets a rider mark a shipment as picked_up, delivered, failed
+// (with a reason) or canceled, recording when it happened.
+func statusPost(w http.ResponseWriter, req *http.Request) {
+	authHeader, claims, ok := authenticate(w, req)
+	if !ok {
+		return
+	}
+
+	var err error // beware of shadowing
+	defer func() {
+		if err != nil {
+			w.WriteHeader(errorStatus(err))
+			fmt.Fprintf(w, "%s", err)
+		}
+	}()
+
+	shipId := req.FormValue("shipmentId")
+	status := req.FormValue("status")
+	reason := strings.TrimSpace(req.FormValue("reason"))
+	if shipId == "" {
+		err = errors.New("No shipmentId provided")
+		return
+	}
+	if status == shipments.StatusFailed && reason == "" {
+		err = errors.New("A reason is required for failed deliveries")
+		return
+	}
+	ship, err := backend.Shipment(req.Context(), authHeader, shipId)
+	if err != nil {
+		return
+	}
+	if ship == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Shipment %s not found", shipId)
+		return
+	}
+	versions := shipmentVersions([]shipments.Shipment{*ship}, []shipments.Shipment{*ship})
+	err = setDeliveryStatus(ship, status, reason, time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "%s", err)
+		err = nil
+		return
+	}
+	err = writeShipments(req.Context(), authHeader, []shipments.Shipment{*ship}, versions)
+	if err != nil {
+		return
+	}
+	notifyShipments([]shipments.Shipment{*ship})
+	switch status {
+	case shipments.StatusDelivered:
+		fireEvent(claims.organization(), eventShipmentDelivered, *ship)
+	case shipments.StatusFailed:
+		fireEvent(claims.organization(), eventShipmentFailed, *ship)
+	}
+	fmt.Fprintf(w, "Shipment %s is now %s", ship.Id, status)
+}
+
+// setDeliveryStatus moves ship to status, if the transition is allowed.
+func setDeliveryStatus(ship *shipments.Shipment, status, reason string, now time.Time) error {
+	from := ship.Data.DeliveryStatus
+	allowed := false
+	for _, to := range statusTransitions[from] {
+		if to == status {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("Shipment %s cannot go from %q to %q", ship.Id, from, status)
+	}
+
+	d := &ship.Data
+	d.DeliveryStatus = status
+	at := now.In(timeZone).Format(time.RFC3339)
+	switch status {
+	case shipments.StatusPickedUp:
+		d.PickedUpAt = at
+	case shipments.StatusDelivered:
+		d.DeliveredAt = at
+	case shipments.StatusFailed:
+		d.FailedAt = at
+		d.FailureReason = reason
+	case shipments.StatusCanceled:
+		d.CanceledAt = at
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/robzan8/taac/shipments"
+)
+
+func TestSetDeliveryStatus(t *testing.T) {
+	startFakes(t)
+	now := time.Date(2024, 3, 4, 10, 30, 0, 0, timeZone)
+	at := now.Format(time.RFC3339)
+	statuses := []string{
+		"", shipments.StatusToBeScheduled, shipments.StatusScheduled, shipments.StatusPickedUp,
+		shipments.StatusDelivered, shipments.StatusFailed, shipments.StatusCanceled,
+	}
+	allowed := map[[2]string]func(shipments.Shipment) bool{
+		{shipments.StatusScheduled, shipments.StatusPickedUp}: func(s shipments.Shipment) bool {
+			return s.Data.PickedUpAt == at
+		},
+		{shipments.StatusScheduled, shipments.StatusFailed}: func(s shipments.Shipment) bool {
+			return s.Data.FailedAt == at && s.Data.FailureReason == "closed"
+		},
+		{shipments.StatusScheduled, shipments.StatusCanceled}: func(s shipments.Shipment) bool {
+			return s.Data.CanceledAt == at
+		},
+		{shipments.StatusPickedUp, shipments.StatusDelivered}: func(s shipments.Shipment) bool {
+			return s.Data.DeliveredAt == at
+		},
+		{shipments.StatusPickedUp, shipments.StatusFailed}: func(s shipments.Shipment) bool {
+			return s.Data.FailedAt == at && s.Data.FailureReason == "closed"
+		},
+	}
+
+	for _, from := range statuses {
+		for _, to := range statuses {
+			var ship shipments.Shipment
+			ship.Id = "1"
+			ship.Data.DeliveryStatus = from
+			before := ship
+			err := setDeliveryStatus(&ship, to, "closed", now)
+
+			check, ok := allowed[[2]string{from, to}]
+			switch {
+			case ok && err != nil:
+				t.Errorf("%q -> %q: %s", from, to, err)
+			case ok && (ship.Data.DeliveryStatus != to || !check(ship)):
+				t.Errorf("%q -> %q: got %+v", from, to, ship.Data)
+			case !ok && err == nil:
+				t.Errorf("%q -> %q allowed", from, to)
+			case !ok && ship != before:
+				t.Errorf("%q -> %q refused, but the shipment changed: %+v", from, to, ship.Data)
+			}
+		}
+	}
+	for from, tos := range statusTransitions {
+		for _, to := range tos {
+			if _, ok := allowed[[2]string{from, to}]; !ok {
+				t.Errorf("transition %q -> %q not tested", from, to)
+			}
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A blobStore keeps the files uploaded as proof of delivery.
+type blobStore interface {
+	Put(ctx context.Context, key, contentType string, data []byte) error
+	Get(ctx context.Context, key string) (data []byte, contentType string, err error)
+}
+
+var errBlobNotFound = errors.New("File not found")
+
+// Keys are of the form "shipment-id/file-name", which is also safe as a path.
+var blobKeyRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+/[A-Za-z0-9_.-]+$`)
+
+// newBlobStore creates the store of the configured kind: "fs" or "s3".
+func newBlobStore() (blobStore, error) {
+	switch c := conf.Storage; c.Kind {
+	case "fs":
+		return fsStore{c.Dir}, os.MkdirAll(c.Dir, 0755)
+	case "s3":
+		return s3Store{
+			Endpoint:  strings.TrimSuffix(c.S3Endpoint, "/"),
+			Bucket:    c.S3Bucket,
+			Region:    c.S3Region,
+			AccessKey: c.S3AccessKey,
+			SecretKey: c.S3SecretKey,
+		}, nil
+	default:
+		return nil, fmt.Errorf("Unknown storage kind %q", c.Kind)
+	}
+}
+
+// fsStore keeps the files in a local directory,
+// with the content type in a ".type" file next to each.
+type fsStore struct {
+	Dir string
+}
+
+func (s fsStore) Put(ctx context.Context, key, contentType string, data []byte) error {
+	if !blobKeyRegex.MatchString(key) {
+		return fmt.Errorf("Invalid file key %q", key)
+	}
+	path := filepath.Join(s.Dir, filepath.FromSlash(key))
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path+".type", []byte(contentType), 0644)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func (s fsStore) Get(ctx context.Context, key string) ([]byte, string, error) {
+	if !blobKeyRegex.MatchString(key) {
+		return nil, "", errBlobNotFound
+	}
+	path := filepath.Join(s.Dir, filepath.FromSlash(key))
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, "", errBlobNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	contentType, err := ioutil.ReadFile(path + ".type")
+	if err != nil {
+		contentType = []byte("application/octet-stream")
+	}
+	return data, string(contentType), nil
+}
+
+// s3Store talks to an S3 compatible service (e.g. MinIO) with path style urls,
+// signing requests with AWS signature version 4.
+type s3Store struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+func (s s3Store) Put(ctx context.Context, key, contentType string, data []byte) error {
+	if !blobKeyRegex.MatchString(key) {
+		return fmt.Errorf("Invalid file key %q", key)
+	}
+	ctx, cancel := context.WithTimeout(ctx, conf.Storage.Timeout)
+	defer cancel()
+	req, err := s.request(ctx, http.MethodPut, key, data)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	s.sign(req, data, time.Now())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("S3 upload responded with status %d:\n%s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+func (s s3Store) Get(ctx context.Context, key string) ([]byte, string, error) {
+	if !blobKeyRegex.MatchString(key) {
+		return nil, "", errBlobNotFound
+	}
+	ctx, cancel := context.WithTimeout(ctx, conf.Storage.Timeout)
+	defer cancel()
+	req, err := s.request(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	s.sign(req, nil, time.Now())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", errBlobNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("S3 download responded with status %d", resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	return data, resp.Header.Get("Content-Type"), err
+}
+
+func (s s3Store) request(ctx context.Context, method, key string, data []byte) (*http.Request, error) {
+	return http.NewRequestWithContext(ctx, method, s.Endpoint+"/"+s.Bucket+"/"+key, bytes.NewReader(data))
+}
+
+func (s s3Store) sign(req *http.Request, payload []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, name := range names {
+		canonHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonRequest := strings.Join([]string{
+		req.Method, req.URL.EscapedPath(), req.URL.RawQuery,
+		canonHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonRequest))
+	key := hmacSha256([]byte("AWS4"+s.SecretKey), day)
+	key = hmacSha256(key, s.Region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robzan8/taac/shipments"
+)
+
+type riderPosition struct {
+	Lat       float64 `json:"lat"`
+	Lon       float64 `json:"lon"`
+	UpdatedAt string  `json:"updated_at"`
+}
+
+var (
+	positions   = make(map[string]map[string]riderPosition) // by organization and rider name
+	positionsMu sync.Mutex
+)
+
+func storePosition(org, rider string, pos riderPosition) {
+	positionsMu.Lock()
+	defer positionsMu.Unlock()
+
+	if positions[org] == nil {
+		positions[org] = make(map[string]riderPosition)
+	}
+	positions[org][rider] = pos
+}
+
+// loadPositions returns the positions of the riders of org.
+func loadPositions(org string) map[string]riderPosition {
+	positionsMu.Lock()
+	defer positionsMu.Unlock()
+
+	copied := make(map[string]riderPosition, len(positions[org]))
+	for rider, pos := range positions[org] {
+		copied[rider] = pos
+	}
+	return copied
+}
+
+func positionEndpoint(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		positionGet(w, req)
+	case http.MethodPost:
+		positionPost(w, req)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unsupported method %s", req.Method)
+	}
+}
+
+// positionPost stores the current GPS position of a rider of the caller's organization,
+// who must be among the riders of the backend.
+func positionPost(w http.ResponseWriter, req *http.Request) {
+	authHeader, claims, ok := authenticate(w, req)
+	if !ok {
+		return
+	}
+	rider := strings.TrimSpace(req.FormValue("rider"))
+	lat, errLat := strconv.ParseFloat(req.FormValue("lat"), 64)
+	lon, errLon := strconv.ParseFloat(req.FormValue("lon"), 64)
+	if rider == "" || errLat != nil || errLon != nil || math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, "rider, lat and lon must be provided")
+		return
+	}
+	riderData, err := backend.Riders(req.Context(), authHeader)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	known := false
+	for _, r := range riderData {
+		known = known || r.Data.Name == rider
+	}
+	if !known {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, "Unknown rider %q", rider)
+		return
+	}
+	storePosition(claims.organization(), rider, riderPosition{lat, lon, time.Now().In(timeZone).Format(time.RFC3339)})
+	fmt.Fprint(w, "OK")
+}
+
+// positionGet returns the latest position of every rider of the caller's organization.
+func positionGet(w http.ResponseWriter, req *http.Request) {
+	_, claims, ok := authenticate(w, req)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(loadPositions(claims.organization()))
+}
+
+// A remaining stop of a rider, with the originally planned time and the current estimate.
+type stopEta struct {
+	ShipmentId string `json:"shipment_id"`
+	Type       string `json:"type"`
+	Address    string `json:"address"`
+	Planned    string `json:"planned"`
+	Eta        string `json:"eta"`
+	DelayMin   int64  `json:"delay_min"`
+}
+
+type riderEtas struct {
+	Rider    string         `json:"rider"`
+	Position *riderPosition `json:"position,omitempty"`
+	Stops    []stopEta      `json:"stops"`
+}
+
+func etaEndpoint(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		etaGet(w, req)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unsupported method %s", req.Method)
+	}
+}
+
+// etaGet recomputes the ETAs of the remaining stops of today,
+// of a single rider if the rider parameter is given.
+func etaGet(w http.ResponseWriter, req *http.Request) {
+	authHeader, claims, ok := authenticate(w, req)
+	if !ok {
+		return
+	}
+	var err error // beware of shadowing
+	defer func() {
+		if err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			fmt.Fprintf(w, "%s", err)
+		}
+	}()
+
+	riderData, err := backend.Riders(req.Context(), authHeader)
+	if err != nil {
+		return
+	}
+	shipData, err := backend.Shipments(req.Context(), authHeader)
+	if err != nil {
+		return
+	}
+	etas, err := computeEtas(req.Context(), riderData, shipData, loadPositions(claims.organization()), time.Now())
+	if err != nil {
+		return
+	}
+	if rider := req.FormValue("rider"); rider != "" {
+		var filtered []riderEtas
+		for _, e := range etas {
+			if e.Rider == rider {
+				filtered = append(filtered, e)
+			}
+		}
+		etas = filtered
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(etas)
+}
+
+// computeEtas estimates, for each rider with stops left today, when each stop will
+// be reached following the remaining route in the planned order. Only the ride from
+// the rider's last known position to the next stop is estimated, see travelTime;
+// the following legs take as long as planned, the solver having computed them on
+// the roads for the rider's vehicle. Without a position, or with one older than
+// conf.Tracking.MaxAge, the rider is assumed to get to the next stop on time.
+func computeEtas(ctx context.Context, riders []shipments.Rider, ships []shipments.Shipment, positions map[string]riderPosition, now time.Time) ([]riderEtas, error) {
+	today := now.In(timeZone).Format(dateLayout)
+	type stop struct {
+		stopEta
+		planned int64
+	}
+	stopsByRider := make(map[string][]stop)
+	for _, s := range ships {
+		d := s.Data
+		if d.ShipmentDay != today || d.RiderName == "" {
+			continue
+		}
+		var toDo []stop
+		switch d.DeliveryStatus {
+		case shipments.StatusScheduled:
+			toDo = append(toDo, stop{stopEta: stopEta{s.Id, "pickup", d.PickupAddress, d.PickupTime, "", 0}})
+			fallthrough
+		case shipments.StatusPickedUp:
+			toDo = append(toDo, stop{stopEta: stopEta{s.Id, "delivery", d.DeliveryAddress, d.DeliveryTime, "", 0}})
+		}
+		for _, st := range toDo {
+			t, err := unixTime(today, st.Planned)
+			if err != nil {
+				return nil, fmt.Errorf("Error in shipment %s: %s", s.Id, err)
+			}
+			st.planned = t
+			stopsByRider[d.RiderName] = append(stopsByRider[d.RiderName], st)
+		}
+	}
+	speedFactors := make(map[string]float64)
+	for _, r := range riders {
+		for _, vt := range planner.VehicleTypes {
+			if vt.Id == r.Data.VehicleTypeId && vt.SpeedFactor > 0 {
+				speedFactors[r.Data.Name] = vt.SpeedFactor
+			}
+		}
+	}
+	serviceTime := func(st stop) int64 {
+		if st.Type == "pickup" {
+			return int64(conf.Schedule.PickupTime / time.Second)
+		}
+		return int64(conf.Schedule.DeliveryTime / time.Second)
+	}
+
+	var etas []riderEtas
+	for rider, stops := range stopsByRider {
+		sort.SliceStable(stops, func(i, j int) bool { return stops[i].planned < stops[j].planned })
+		re := riderEtas{Rider: rider}
+		t := now.Unix()
+		pos, ok := positions[rider]
+		if updated, err := time.Parse(time.RFC3339, pos.UpdatedAt); err != nil || now.Sub(updated) > conf.Tracking.MaxAge {
+			ok = false
+		}
+		if ok {
+			re.Position = &pos
+			lat, lon, err := geocoder.Geocode(ctx, stops[0].Address)
+			if err != nil {
+				return nil, err
+			}
+			speedFactor, ok := speedFactors[rider]
+			if !ok {
+				speedFactor = 1
+			}
+			t += travelTime(pos.Lat, pos.Lon, lat, lon, speedFactor)
+		} else if stops[0].planned > t {
+			t = stops[0].planned
+		}
+		for i, st := range stops {
+			if i > 0 {
+				prev := stops[i-1]
+				if leg := st.planned - prev.planned - serviceTime(prev); leg > 0 {
+					t += leg
+				}
+			}
+			// Riders don't show up before the planned time.
+			if t < st.planned {
+				t = st.planned
+			}
+			st.Eta = formatTime(t)
+			st.DelayMin = (t - st.planned) / 60
+			re.Stops = append(re.Stops, st.stopEta)
+			t += serviceTime(st)
+		}
+		etas = append(etas, re)
+	}
+	sort.Slice(etas, func(i, j int) bool { return etas[i].Rider < etas[j].Rider })
+	return etas, nil
+}
+
+// travelTime estimates the seconds needed to ride between two points
+// with a vehicle of the given speed factor.
+func travelTime(lat1, lon1, lat2, lon2, speedFactor float64) int64 {
+	km := distanceKm(lat1, lon1, lat2, lon2) * conf.Tracking.DetourFactor
+	return int64(km / (conf.Tracking.RiderSpeed * speedFactor) * 3600)
+}
+
+// estimateKm estimates the kilometres ridden between two addresses.
+func estimateKm(ctx context.Context, from, to string) (float64, error) {
+	lat1, lon1, err := geocoder.Geocode(ctx, from)
+	if err != nil {
+		return 0, err
+	}
+	lat2, lon2, err := geocoder.Geocode(ctx, to)
+	if err != nil {
+		return 0, err
+	}
+	return distanceKm(lat1, lon1, lat2, lon2) * conf.Tracking.DetourFactor, nil
+}
+
+// distanceKm is the great circle distance between two points.
+func distanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadius = 6371.0
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robzan8/taac/shipments"
+)
+
+func TestPositionPostOnlyForKnownRiders(t *testing.T) {
+	s := startFakes(t)
+	addRiders(t, s, "Anna")
+	post := func(rider string) int {
+		form := url.Values{"rider": {rider}, "lat": {"45.46"}, "lon": {"9.19"}}
+		req := httptest.NewRequest(http.MethodPost, "/position.json", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return do(t, s, req).Code
+	}
+
+	if code := post("Anna"); code != http.StatusOK {
+		t.Errorf("position of Anna: status %d", code)
+	}
+	if code := post("Mallory"); code != http.StatusUnprocessableEntity {
+		t.Errorf("position of an unknown rider: status %d, want %d", code, http.StatusUnprocessableEntity)
+	}
+	positions := loadPositions("user:" + testUser)
+	if _, ok := positions["Mallory"]; ok || len(positions) != 1 {
+		t.Errorf("stored positions: %v, want only Anna's", positions)
+	}
+}
+
+// A rider far from the next stop is late, unless the position is too old to tell.
+func TestComputeEtasIgnoresStalePositions(t *testing.T) {
+	startFakes(t)
+	now := time.Now().In(timeZone)
+	var ship shipments.Shipment
+	ship.Id = "1"
+	ship.Data.ShipmentDay = now.Format(dateLayout)
+	ship.Data.RiderName = "Anna"
+	ship.Data.DeliveryStatus = shipments.StatusPickedUp
+	ship.Data.DeliveryAddress = "Via Po 2 Milano"
+	ship.Data.DeliveryTime = now.Format("15:04")
+	farAway := func(age time.Duration) map[string]riderPosition {
+		return map[string]riderPosition{"Anna": {45.07, 7.69, now.Add(-age).Format(time.RFC3339)}}
+	}
+
+	for _, test := range []struct {
+		age  time.Duration
+		late bool
+	}{
+		{time.Minute, true},
+		{conf.Tracking.MaxAge + time.Minute, false},
+	} {
+		etas, err := computeEtas(context.Background(), nil, []shipments.Shipment{ship}, farAway(test.age), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(etas) != 1 || len(etas[0].Stops) != 1 {
+			t.Fatalf("got %+v, want the delivery of Anna", etas)
+		}
+		if late := etas[0].Stops[0].DelayMin > 0; late != test.late || (etas[0].Position != nil) != test.late {
+			t.Errorf("position %s old: got %+v, late %v", test.age, etas[0], late)
+		}
+	}
+}
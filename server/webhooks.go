@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	eventScheduleCommitted = "schedule.committed"
+	eventShipmentAssigned  = "shipment.assigned"
+	eventShipmentDelivered = "shipment.delivered"
+	eventShipmentFailed    = "shipment.failed"
+)
+
+// A webhookDelivery is an event sent, or being sent, to a webhook.
+type webhookDelivery struct {
+	Id        string          `json:"id"`
+	Event     string          `json:"event"`
+	Url       string          `json:"url"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+	Status    string          `json:"status"` // pending, delivered or failed
+	LastError string          `json:"last_error,omitempty"`
+	CreatedAt string          `json:"created_at"`
+	UpdatedAt string          `json:"updated_at"`
+
+	org    string // of the user whose action fired the event
+	secret string
+}
+
+const (
+	webhookMaxAttempts = 6
+	webhookFirstRetry  = 2 * time.Second // doubled at each attempt
+	webhookLogCap      = 1000
+)
+
+var (
+	webhookLog   []*webhookDelivery // oldest first
+	webhookLogMu sync.Mutex
+)
+
+// fireEvent sends event with data to the interested webhooks of org, in the background.
+// The deliveries are visible to the admins of org.
+func fireEvent(org, event string, data interface{}) {
+	if len(conf.Webhooks) == 0 {
+		return
+	}
+	now := time.Now().In(timeZone).Format(time.RFC3339)
+	payload, err := json.Marshal(map[string]interface{}{
+		"event":      event,
+		"created_at": now,
+		"data":       data,
+	})
+	if err != nil {
+		log.Printf("Webhook event %s: %s", event, err)
+		return
+	}
+	for _, h := range conf.Webhooks {
+		if h.Org != org || !h.Wants(event) {
+			continue
+		}
+		d := &webhookDelivery{
+			Id:        randomId(),
+			Event:     event,
+			Url:       h.Url,
+			Payload:   payload,
+			Status:    "pending",
+			CreatedAt: now,
+			UpdatedAt: now,
+			org:       org,
+			secret:    h.Secret,
+		}
+		logDelivery(d)
+		startDelivery(d)
+	}
+}
+
+func logDelivery(d *webhookDelivery) {
+	webhookLogMu.Lock()
+	defer webhookLogMu.Unlock()
+
+	webhookLog = append(webhookLog, d)
+	if len(webhookLog) > webhookLogCap {
+		webhookLog = webhookLog[len(webhookLog)-webhookLogCap:]
+	}
+}
+
+// startDelivery delivers d in the background, or marks it as failed when shutting down.
+func startDelivery(d *webhookDelivery) {
+	if goBackground(func() { deliverWebhook(d) }) {
+		return
+	}
+	webhookLogMu.Lock()
+	d.Status, d.LastError = "failed", "Server shutting down"
+	webhookLogMu.Unlock()
+	log.Printf("Webhook delivery %s to %s: not sent, shutting down", d.Id, d.Url)
+}
+
+// deliverWebhook posts the payload, retrying with exponential backoff
+// until the shutdown starts.
+func deliverWebhook(d *webhookDelivery) {
+	retry := webhookFirstRetry
+	for {
+		err := postWebhook(d)
+
+		webhookLogMu.Lock()
+		d.Attempts++
+		d.UpdatedAt = time.Now().In(timeZone).Format(time.RFC3339)
+		done := true
+		switch {
+		case err == nil:
+			d.Status, d.LastError = "delivered", ""
+		case d.Attempts >= webhookMaxAttempts:
+			d.Status, d.LastError = "failed", err.Error()
+		default:
+			d.LastError = err.Error()
+			done = false
+		}
+		webhookLogMu.Unlock()
+
+		if done {
+			return
+		}
+		select {
+		case <-time.After(retry):
+		case <-backgroundCtx.Done():
+			log.Printf("Webhook delivery %s to %s: not retried, shutting down", d.Id, d.Url)
+			return
+		}
+		retry *= 2
+	}
+}
+
+// postWebhook signs the payload with the webhook secret as
+// X-Taac-Signature: sha256=<hex hmac>, so receivers can verify it.
+func postWebhook(d *webhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, d.Url, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Taac-Event", d.Event)
+	req.Header.Set("X-Taac-Delivery", d.Id)
+	if d.secret != "" {
+		mac := hmac.New(sha256.New, []byte(d.secret))
+		mac.Write(d.Payload)
+		req.Header.Set("X-Taac-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func randomId() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func webhooksEndpoint(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		webhooksGet(w, req)
+	case http.MethodPost:
+		webhooksPost(w, req)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unsupported method %s", req.Method)
+	}
+}
+
+// authenticateAdmin is like authenticate, but also requires one of conf.Auth.AdminRoles.
+func authenticateAdmin(w http.ResponseWriter, req *http.Request) (claims hasuraClaims, ok bool) {
+	_, claims, ok = authenticate(w, req)
+	if !ok {
+		return claims, false
+	}
+	if !claims.hasRole(conf.Auth.AdminRoles) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Only admins can access the webhook deliveries")
+		return claims, false
+	}
+	return claims, true
+}
+
+// webhooksGet returns the delivery log of the caller's organization, most recent first.
+func webhooksGet(w http.ResponseWriter, req *http.Request) {
+	claims, ok := authenticateAdmin(w, req)
+	if !ok {
+		return
+	}
+	org := claims.organization()
+	webhookLogMu.Lock()
+	deliveries := make([]webhookDelivery, 0, len(webhookLog))
+	for i := len(webhookLog) - 1; i >= 0; i-- {
+		if webhookLog[i].org == org {
+			deliveries = append(deliveries, *webhookLog[i])
+		}
+	}
+	webhookLogMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// webhooksPost replays the delivery with the given id, as a new delivery.
+func webhooksPost(w http.ResponseWriter, req *http.Request) {
+	claims, ok := authenticateAdmin(w, req)
+	if !ok {
+		return
+	}
+	id := req.FormValue("replay")
+	var orig *webhookDelivery
+	webhookLogMu.Lock()
+	for _, d := range webhookLog {
+		if d.Id == id && d.org == claims.organization() {
+			orig = d
+		}
+	}
+	var d webhookDelivery
+	if orig != nil {
+		d = *orig
+	}
+	webhookLogMu.Unlock()
+	if orig == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Webhook delivery %q not found", id)
+		return
+	}
+
+	now := time.Now().In(timeZone).Format(time.RFC3339)
+	d.Id, d.Attempts, d.Status, d.LastError = randomId(), 0, "pending", ""
+	d.CreatedAt, d.UpdatedAt = now, now
+	logDelivery(&d)
+	startDelivery(&d)
+	fmt.Fprintf(w, "Replaying as delivery %s", d.Id)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/robzan8/taac/config"
+)
+
+func TestFireEventOnlyToTheOrganization(t *testing.T) {
+	startFakes(t)
+	var mu sync.Mutex
+	received := make(map[string]int) // by organization
+	receiver := func(org string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			received[org]++
+			mu.Unlock()
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	conf.Webhooks = []config.Webhook{
+		{Url: receiver("acme").URL, Org: "acme"},
+		{Url: receiver("other").URL, Org: "other"},
+		{Url: receiver("acme-failed").URL, Org: "acme", Events: []string{eventShipmentFailed}},
+	}
+
+	fireEvent("acme", eventShipmentDelivered, map[string]string{"id": "1"})
+	background.Wait()
+
+	if received["acme"] != 1 || received["other"] != 0 || received["acme-failed"] != 0 {
+		t.Errorf("deliveries by receiver: %v, want only one to acme", received)
+	}
+}
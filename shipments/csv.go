@@ -0,0 +1,109 @@
+package shipments
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ReadCsv reads shipments from a CSV with a header and the columns
+// notes, pickup address and delivery address. Each shipment has the given size.
+func ReadCsv(in io.Reader, size int) ([]Shipment, error) {
+	var ships []Shipment
+	r := csv.NewReader(in)
+	_, err := r.Read() // read away the header
+	if err == io.EOF {
+		return nil, fmt.Errorf("Empty shipments file")
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; true; i++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(rec) != 3 {
+			return nil, fmt.Errorf("Line in shipments csv must have 3 entries")
+		}
+		var s Shipment
+		s.Id = strconv.Itoa(i)
+		s.Data.Size = size
+		s.Data.PickupAddress = rec[1]
+		s.Data.DeliveryAddress = rec[2]
+		s.Data.Notes = rec[0]
+		ships = append(ships, s)
+	}
+	return ships, nil
+}
+
+// WriteCsv writes the schedule of ships as a CSV, with Italian headers.
+func WriteCsv(out io.Writer, ships []Shipment) error {
+	w := csv.NewWriter(out)
+	err := w.Write([]string{
+		"rider", "destinatario/contatti/note", "indirizzo di ritiro",
+		"indirizzo di consegna", "giorno", "orario di ritiro", "orario di consegna",
+	})
+	if err != nil {
+		return err
+	}
+	for _, s := range ships {
+		d := s.Data
+		err = w.Write([]string{
+			d.RiderName, d.Notes, d.PickupAddress, d.DeliveryAddress,
+			d.ShipmentDay, d.PickupTime, d.DeliveryTime,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// ReadCsvRiders reads riders from a CSV with a header and the columns name,
+// start address, start and end of the shift and, optionally, vehicle type.
+// Riders without a vehicle type get vehicleType. The name is also the id.
+func ReadCsvRiders(in io.Reader, vehicleType string) ([]Rider, error) {
+	var riders []Rider
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	_, err := r.Read() // read away the header
+	if err == io.EOF {
+		return nil, fmt.Errorf("Empty riders file")
+	}
+	if err != nil {
+		return nil, err
+	}
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(rec) != 4 && len(rec) != 5 {
+			return nil, fmt.Errorf("Line in riders csv must have 4 or 5 entries")
+		}
+		var rider Rider
+		rider.Id = strings.TrimSpace(rec[0])
+		rider.Data.Name = rider.Id
+		rider.Data.StartAddress = rec[1]
+		rider.Data.EarliestStart = strings.TrimSpace(rec[2])
+		rider.Data.LatestEnd = strings.TrimSpace(rec[3])
+		rider.Data.VehicleTypeId = vehicleType
+		if len(rec) == 5 && rec[4] != "" {
+			rider.Data.VehicleTypeId = strings.TrimSpace(rec[4])
+		}
+		riders = append(riders, rider)
+	}
+	return riders, nil
+}
@@ -0,0 +1,205 @@
+package shipments
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/robzan8/taac/geocode"
+	"github.com/robzan8/taac/vrp"
+)
+
+// Default times spent at each stop.
+const (
+	DefaultPickupTime   = 15 * time.Minute
+	DefaultDeliveryTime = 5 * time.Minute
+)
+
+// A Planner turns riders and shipments into route optimization problems
+// and writes the solutions back into the shipments.
+type Planner struct {
+	Geocoder     *geocode.Client
+	Solver       *vrp.Solver
+	VehicleTypes []vrp.VehicleType
+	Location     *time.Location // of the dates and times of day
+	PickupTime   time.Duration  // spent at each pickup
+	DeliveryTime time.Duration  // spent at each delivery
+}
+
+// NewPlanner returns a Planner for times in loc, with a cargo bike
+// vehicle type and the default times at each stop.
+func NewPlanner(geocoder *geocode.Client, solver *vrp.Solver, loc *time.Location) *Planner {
+	return &Planner{
+		Geocoder:     geocoder,
+		Solver:       solver,
+		VehicleTypes: []vrp.VehicleType{vrp.CargoBike},
+		Location:     loc,
+		PickupTime:   DefaultPickupTime,
+		DeliveryTime: DefaultDeliveryTime,
+	}
+}
+
+// Vehicle converts the shift of r on day to a vehicle, geocoding its start address.
+func (p *Planner) Vehicle(ctx context.Context, r Rider, day string) (v vrp.Vehicle, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("Error in rider %s: %s", r.Id, err)
+		}
+	}()
+	lat, lon, err := p.Geocoder.Geocode(ctx, r.Data.StartAddress)
+	if err != nil {
+		return
+	}
+	start, end, err := ShiftTimes(p.Location, day, r.Data.EarliestStart, r.Data.LatestEnd)
+	if err != nil {
+		return
+	}
+	return vrp.Vehicle{
+		Id:            r.Data.Name,
+		Type:          r.Data.VehicleTypeId,
+		StartAddress:  vrp.Address{Str: r.Data.StartAddress, Lat: lat, Lon: lon},
+		EarliestStart: start,
+		LatestEnd:     end,
+	}, nil
+}
+
+// Shipment converts s, to be delivered on day, to a vrp shipment, geocoding its addresses.
+// dayStart is the earliest start of the shifts of day, see DayStart: latest delivery
+// times before it are on the following day, for overnight shifts.
+func (p *Planner) Shipment(ctx context.Context, s Shipment, day string, dayStart int64) (vs vrp.Shipment, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("Error in shipment %s: %s", s.Id, err)
+		}
+	}()
+	var (
+		pickupAddr   = vrp.Address{Str: s.Data.PickupAddress}
+		deliveryAddr = vrp.Address{Str: s.Data.DeliveryAddress}
+	)
+	pickupAddr.Lat, pickupAddr.Lon, err = p.Geocoder.Geocode(ctx, pickupAddr.Str)
+	if err != nil {
+		return
+	}
+	deliveryAddr.Lat, deliveryAddr.Lon, err = p.Geocoder.Geocode(ctx, deliveryAddr.Str)
+	if err != nil {
+		return
+	}
+	var deliveryTimeWindows []vrp.TimeWindow
+	if s.Data.LatestDeliveryTime != "" {
+		var t int64
+		t, err = DeadlineTime(p.Location, day, s.Data.LatestDeliveryTime, dayStart)
+		if err != nil {
+			return
+		}
+		deliveryTimeWindows = []vrp.TimeWindow{{Earliest: 0, Latest: t}}
+	}
+	return vrp.Shipment{
+		Id:   s.Id,
+		Size: [1]int{s.Data.Size},
+		Pickup: vrp.Delivery{
+			Address:  pickupAddr,
+			PrepTime: int64(p.PickupTime / time.Second),
+		},
+		Delivery: vrp.Delivery{
+			Address:     deliveryAddr,
+			PrepTime:    int64(p.DeliveryTime / time.Second),
+			TimeWindows: deliveryTimeWindows,
+		},
+	}, nil
+}
+
+// DayStart returns the earliest start of vehicles, 0 if there are none.
+func DayStart(vehicles []vrp.Vehicle) int64 {
+	var start int64
+	for _, v := range vehicles {
+		if start == 0 || v.EarliestStart < start {
+			start = v.EarliestStart
+		}
+	}
+	return start
+}
+
+// Problem converts riders and ships to the problem of delivering ships on day.
+func (p *Planner) Problem(ctx context.Context, riders []Rider, ships []Shipment, day string) (vrp.Problem, error) {
+	prob := vrp.Problem{VehicleTypes: p.VehicleTypes}
+	for _, r := range riders {
+		v, err := p.Vehicle(ctx, r, day)
+		if err != nil {
+			return prob, err
+		}
+		prob.Vehicles = append(prob.Vehicles, v)
+	}
+	dayStart := DayStart(prob.Vehicles)
+	for _, s := range ships {
+		vs, err := p.Shipment(ctx, s, day, dayStart)
+		if err != nil {
+			return prob, err
+		}
+		prob.Shipments = append(prob.Shipments, vs)
+	}
+	return prob, nil
+}
+
+// Solve solves prob, made from ships with Problem, writes the solution into ships
+// and sorts them by rider and delivery time, the unassigned ones last.
+func (p *Planner) Solve(ctx context.Context, prob vrp.Problem, ships []Shipment, day string) (vrp.Solution, error) {
+	sol, err := p.Solver.Solve(ctx, prob)
+	if err != nil {
+		return sol, err
+	}
+	p.WriteSolution(ships, sol, day)
+	sort.SliceStable(ships, func(i, j int) bool {
+		return ships[i].Data.DeliveryTime < ships[j].Data.DeliveryTime
+	})
+	sort.SliceStable(ships, func(i, j int) bool {
+		// We want unassigned shipments at the end.
+		if ships[i].Data.RiderName == "" {
+			return false
+		}
+		if ships[j].Data.RiderName == "" {
+			return true
+		}
+		return ships[i].Data.RiderName < ships[j].Data.RiderName
+	})
+	return sol, nil
+}
+
+// WriteSolution schedules the shipments of ships that are in a route of sol on day.
+func (p *Planner) WriteSolution(ships []Shipment, sol vrp.Solution, day string) {
+	shipsById := make(map[string]*Shipment)
+	for i, s := range ships {
+		shipsById[s.Id] = &ships[i]
+	}
+	for _, route := range sol.Solution.Routes {
+		riderName := route.VehicleId
+		numShips := 0
+		for _, act := range route.Activities {
+			if act.Type == vrp.ActivityTypeDeliver {
+				numShips++
+			}
+		}
+		for _, act := range route.Activities {
+			switch act.Type {
+			case vrp.ActivityTypePickup:
+				ship := shipsById[act.ShipmentId]
+				ship.Data.DeliveryStatus = StatusScheduled
+				ship.Data.RiderName = riderName
+				ship.Data.ShipmentDay = day
+				pickupTime := act.ArrivalTime
+				if pickupTime == 0 {
+					pickupTime = act.EndTime
+				}
+				ship.Data.PickupTime = FormatTime(p.Location, pickupTime)
+			case vrp.ActivityTypeDeliver:
+				ship := shipsById[act.ShipmentId]
+				deliveryTime := act.ArrivalTime
+				if deliveryTime == 0 {
+					deliveryTime = act.EndTime
+				}
+				ship.Data.DeliveryTime = FormatTime(p.Location, deliveryTime)
+				ship.Data.RouteKm = float64(route.Distance) / 1000 / float64(numShips)
+			}
+		}
+	}
+}
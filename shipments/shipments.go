@@ -0,0 +1,91 @@
+// Package shipments holds the shipment and rider records of taac, as stored in nhost
+// and exchanged as CSV, and plans them into routes with the vrp and geocode packages.
+package shipments
+
+import (
+	"strings"
+	"time"
+)
+
+// A Shipment as stored in the nhost form_data table.
+type Shipment struct {
+	Id     string `json:"id"`
+	User   string `json:"user_data_ref_id"`
+	Schema string `json:"schema_id"`
+	Data   struct {
+		Size               int    `json:"size"`
+		PickupAddress      string `json:"pickup_address"`
+		DeliveryAddress    string `json:"delivery_address"`
+		Notes              string `json:"notes"`
+		RecipientEmail     string `json:"recipient_email,omitempty"`
+		RecipientPhone     string `json:"recipient_phone,omitempty"`
+		Language           string `json:"language,omitempty"` // of notifications, "it" or "en"
+		Deadline           string `json:"deadline,omitempty"`
+		LatestDeliveryTime string `json:"latest_delivery_time"`
+
+		RiderName      string `json:"rider_name"`
+		ShipmentDay    string `json:"shipment_day,omitempty"`
+		PickupTime     string `json:"pickup_time"`
+		DeliveryTime   string `json:"delivery_time"`
+		DeliveryStatus string `json:"delivery_status"`
+		// Share of the planned route of the rider, in km: its distance over its shipments.
+		RouteKm float64 `json:"route_km,omitempty"`
+
+		PickedUpAt    string `json:"picked_up_at,omitempty"`
+		DeliveredAt   string `json:"delivered_at,omitempty"`
+		FailedAt      string `json:"failed_at,omitempty"`
+		FailureReason string `json:"failure_reason,omitempty"`
+		CanceledAt    string `json:"canceled_at,omitempty"`
+
+		Proof *Proof `json:"proof_of_delivery,omitempty"`
+	} `json:"data"`
+}
+
+// Delivery statuses of a shipment.
+const (
+	StatusToBeScheduled = "to_be_scheduled"
+	StatusScheduled     = "scheduled"
+	StatusPickedUp      = "picked_up"
+	StatusDelivered     = "delivered"
+	StatusFailed        = "failed"
+	StatusCanceled      = "canceled"
+)
+
+// A Proof of delivery. The urls point to images kept by the server.
+type Proof struct {
+	RecipientName string `json:"recipient_name"`
+	PhotoUrl      string `json:"photo_url,omitempty"`
+	SignatureUrl  string `json:"signature_url,omitempty"`
+	RecordedAt    string `json:"recorded_at"`
+}
+
+// A Rider as stored in the nhost form_data table.
+type Rider struct {
+	Id   string `json:"id"`
+	Data struct {
+		Name          string `json:"name"`
+		VehicleTypeId string `json:"vehicle_type_id"`
+		StartAddress  string `json:"start_address"`
+		EarliestStart string `json:"earliest_start"`
+		LatestEnd     string `json:"latest_end"`
+		// Weekdays the rider works on, e.g. ["monday", "thu"].
+		AvailableDays []string `json:"available_days,omitempty"`
+	} `json:"data"`
+}
+
+// AvailableOn reports whether the rider works on the weekday.
+// Days are English names or their three letter abbreviations,
+// no declared day means available every day.
+func (r Rider) AvailableOn(day time.Weekday) bool {
+	if len(r.Data.AvailableDays) == 0 {
+		return true
+	}
+	for _, d := range r.Data.AvailableDays {
+		d = strings.ToLower(strings.TrimSpace(d))
+		name := strings.ToLower(day.String())
+		if d == name || d == name[:3] {
+			return true
+		}
+	}
+	return false
+}
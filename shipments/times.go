@@ -0,0 +1,73 @@
+package shipments
+
+import (
+	"fmt"
+	"time"
+)
+
+// DateLayout is the format of dates, as in "2022-12-31".
+const DateLayout = "2006-01-02"
+
+// FormatTime formats a unix timestamp as ISO 8601 in loc.
+func FormatTime(loc *time.Location, unixTime int64) string {
+	return time.Unix(unixTime, 0).In(loc).Format(time.RFC3339)
+}
+
+// UnixTime converts a time of day on date ("2022-12-31") in loc to a unix timestamp.
+// The time is in the format "23:59" or a full ISO 8601 timestamp, in which case date is ignored.
+func UnixTime(loc *time.Location, date, hourMin string) (int64, error) {
+	if t, err := time.Parse(time.RFC3339, hourMin); err == nil {
+		return t.Unix(), nil
+	}
+	var hour, min int
+	_, err := fmt.Sscanf(hourMin, "%d:%d", &hour, &min)
+	if err != nil || hour < 0 || hour > 23 || min < 0 || min > 59 {
+		return 0, fmt.Errorf("Wrongly formatted time %q", hourMin)
+	}
+	d, err := time.ParseInLocation(DateLayout, date, loc)
+	if err != nil {
+		return 0, fmt.Errorf("Wrongly formatted date %q", date)
+	}
+	return time.Date(d.Year(), d.Month(), d.Day(), hour, min, 0, 0, loc).Unix(), nil
+}
+
+// ShiftTimes returns the start and end timestamps of a shift on date in loc.
+// A shift whose end time of day comes before its start ends on the following day.
+func ShiftTimes(loc *time.Location, date, start, end string) (startTime, endTime int64, err error) {
+	startTime, err = UnixTime(loc, date, start)
+	if err != nil {
+		return
+	}
+	endTime, err = UnixTime(loc, date, end)
+	if err != nil || endTime > startTime {
+		return
+	}
+	d, err := time.Parse(DateLayout, date)
+	if err != nil {
+		return
+	}
+	endTime, err = UnixTime(loc, d.AddDate(0, 0, 1).Format(DateLayout), end)
+	if err == nil && endTime <= startTime {
+		err = fmt.Errorf("Shift ends at %q before starting at %q", end, start)
+	}
+	return
+}
+
+// DeadlineTime converts the latest delivery time hourMin of a shipment delivered on date
+// to a unix timestamp in loc. Like the end of an overnight shift, a time of day before
+// dayStart, when the first shift of date starts, is on the following day.
+// A dayStart of 0 keeps every time on date.
+func DeadlineTime(loc *time.Location, date, hourMin string, dayStart int64) (int64, error) {
+	t, err := UnixTime(loc, date, hourMin)
+	if err != nil || t >= dayStart {
+		return t, err
+	}
+	if _, err := time.Parse(time.RFC3339, hourMin); err == nil {
+		return t, nil // a full timestamp
+	}
+	d, err := time.Parse(DateLayout, date)
+	if err != nil {
+		return 0, fmt.Errorf("Wrongly formatted date %q", date)
+	}
+	return UnixTime(loc, d.AddDate(0, 0, 1).Format(DateLayout), hourMin)
+}
@@ -0,0 +1,87 @@
+package shipments
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata" // in case the host has no timezone database
+)
+
+func rome(t *testing.T) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+// In Europe/Rome, clocks go from 2:00 to 3:00 on 2024-03-31 and from 3:00 to 2:00 on 2024-10-27.
+func TestShiftTimes(t *testing.T) {
+	loc := rome(t)
+	for _, test := range []struct {
+		date, start, end string
+		wantStart        time.Time
+		wantHours        float64
+	}{
+		{"2024-03-04", "09:00", "17:00", time.Date(2024, 3, 4, 9, 0, 0, 0, loc), 8},
+		{"2024-03-04", "22:00", "02:00", time.Date(2024, 3, 4, 22, 0, 0, 0, loc), 4},
+		{"2024-03-31", "00:00", "06:00", time.Date(2024, 3, 31, 0, 0, 0, 0, loc), 5},
+		{"2024-03-30", "22:00", "06:00", time.Date(2024, 3, 30, 22, 0, 0, 0, loc), 7},
+		{"2024-10-27", "00:00", "06:00", time.Date(2024, 10, 27, 0, 0, 0, 0, loc), 7},
+		{"2024-10-26", "22:00", "06:00", time.Date(2024, 10, 26, 22, 0, 0, 0, loc), 9},
+		{"2024-12-31", "20:00", "01:30", time.Date(2024, 12, 31, 20, 0, 0, 0, loc), 5.5},
+	} {
+		start, end, err := ShiftTimes(loc, test.date, test.start, test.end)
+		if err != nil {
+			t.Errorf("%s %s-%s: %s", test.date, test.start, test.end, err)
+			continue
+		}
+		hours := time.Duration(end-start) * time.Second
+		if start != test.wantStart.Unix() || hours.Hours() != test.wantHours {
+			t.Errorf("%s %s-%s: starts at %s and lasts %s, want %s and %vh", test.date, test.start, test.end,
+				FormatTime(loc, start), hours, test.wantStart.Format(time.RFC3339), test.wantHours)
+		}
+	}
+
+	for _, bad := range [][3]string{
+		{"2024-03-04", "9", "17:00"},
+		{"2024-03-04", "09:00", "24:00"},
+		{"04/03/2024", "09:00", "17:00"},
+	} {
+		if _, _, err := ShiftTimes(loc, bad[0], bad[1], bad[2]); err == nil {
+			t.Errorf("%v: no error", bad)
+		}
+	}
+}
+
+func TestDeadlineTime(t *testing.T) {
+	loc := rome(t)
+	dayStart := func(y int, m time.Month, d, hour int) int64 {
+		return time.Date(y, m, d, hour, 0, 0, 0, loc).Unix()
+	}
+	for _, test := range []struct {
+		date, hourMin string
+		dayStart      int64
+		want          time.Time
+	}{
+		{"2024-03-04", "18:00", 0, time.Date(2024, 3, 4, 18, 0, 0, 0, loc)},
+		{"2024-03-04", "08:00", 0, time.Date(2024, 3, 4, 8, 0, 0, 0, loc)},
+		{"2024-03-04", "18:00", dayStart(2024, 3, 4, 9), time.Date(2024, 3, 4, 18, 0, 0, 0, loc)},
+		// Before the first shift: the night after.
+		{"2024-03-04", "01:00", dayStart(2024, 3, 4, 22), time.Date(2024, 3, 5, 1, 0, 0, 0, loc)},
+		{"2024-03-30", "04:00", dayStart(2024, 3, 30, 22), time.Date(2024, 3, 31, 4, 0, 0, 0, loc)},
+		{"2024-10-26", "04:00", dayStart(2024, 10, 26, 22), time.Date(2024, 10, 27, 4, 0, 0, 0, loc)},
+		{"2024-12-31", "00:30", dayStart(2024, 12, 31, 20), time.Date(2025, 1, 1, 0, 30, 0, 0, loc)},
+		// Full timestamps are never moved.
+		{"2024-03-04", "2024-03-04T08:00:00+01:00", dayStart(2024, 3, 4, 9), time.Date(2024, 3, 4, 8, 0, 0, 0, loc)},
+	} {
+		got, err := DeadlineTime(loc, test.date, test.hourMin, test.dayStart)
+		if err != nil {
+			t.Errorf("%s %s: %s", test.date, test.hourMin, err)
+			continue
+		}
+		if got != test.want.Unix() {
+			t.Errorf("%s %s: got %s, want %s", test.date, test.hourMin, FormatTime(loc, got), test.want.Format(time.RFC3339))
+		}
+	}
+}
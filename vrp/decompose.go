@@ -0,0 +1,223 @@
+package vrp
+
+import (
+	"context"
+	"errors"
+	"sort"
+)
+
+// NumLocations counts the distinct locations of prob, as the solver backends do.
+func NumLocations(prob Problem) int {
+	locs := vehicleLocations(prob.Vehicles)
+	return len(locs) + numNewLocations(prob.Shipments, locs)
+}
+
+func vehicleLocations(vehicles []Vehicle) map[string]bool {
+	locs := make(map[string]bool)
+	for _, v := range vehicles {
+		locs[v.StartAddress.Str] = true
+	}
+	return locs
+}
+
+// numNewLocations counts the locations of ships that are not in known.
+func numNewLocations(ships []Shipment, known map[string]bool) int {
+	locs := make(map[string]bool)
+	for _, s := range ships {
+		for _, addr := range []string{s.Pickup.Address.Str, s.Delivery.Address.Str} {
+			if !known[addr] {
+				locs[addr] = true
+			}
+		}
+	}
+	return len(locs)
+}
+
+// solveDecomposed splits the shipments of prob into geographic clusters that fit
+// in maxLocs locations and solves each cluster with a subset of the vehicles.
+// If there are more clusters than vehicles, a vehicle serves its clusters
+// one after another, starting the next one when it's back from the previous.
+// Shipments restricted to some vehicles are solved first, with the first of them,
+// so that the clusters cannot separate them from their vehicle.
+func (s *Solver) solveDecomposed(ctx context.Context, prob Problem, maxLocs int) (Solution, error) {
+	var merged Solution
+	if len(prob.Vehicles) == 0 {
+		return merged, errors.New("No vehicles in the problem")
+	}
+	starts := vehicleLocations(prob.Vehicles)
+	if len(starts)+2 > maxLocs {
+		return merged, errors.New("Too many distinct rider start addresses for the solver")
+	}
+	vehicles := make([]Vehicle, len(prob.Vehicles))
+	copy(vehicles, prob.Vehicles)
+
+	pinned := make(map[string][]Shipment) // by vehicle id
+	var ships []Shipment
+	for _, ship := range prob.Shipments {
+		if len(ship.AllowedVehicles) == 0 {
+			ships = append(ships, ship)
+			continue
+		}
+		vehicleId := ""
+		for _, id := range ship.AllowedVehicles {
+			for _, v := range vehicles {
+				if v.Id == id && vehicleId == "" {
+					vehicleId = id
+				}
+			}
+		}
+		if vehicleId == "" {
+			merged.Solution.Unassigned.Shipments = append(merged.Solution.Unassigned.Shipments, ship.Id)
+			continue
+		}
+		pinned[vehicleId] = append(pinned[vehicleId], ship)
+	}
+	for i := range vehicles {
+		v := &vehicles[i]
+		if len(pinned[v.Id]) == 0 {
+			continue
+		}
+		clusters := bisectShipments(pinned[v.Id], vehicleLocations([]Vehicle{*v}), maxLocs)
+		err := s.solveInTurn(ctx, &merged, v, prob.VehicleTypes, clusters)
+		if err != nil {
+			return merged, err
+		}
+	}
+	if len(ships) == 0 {
+		return merged, nil
+	}
+	clusters := bisectShipments(ships, starts, maxLocs)
+
+	numClusters, numVehicles := len(clusters), len(vehicles)
+	if numClusters <= numVehicles {
+		// Vehicle i goes to cluster i*numClusters/numVehicles, which covers all clusters.
+		for j, cluster := range clusters {
+			var clusterVehicles []Vehicle
+			for i, v := range vehicles {
+				if i*numClusters/numVehicles == j && v.EarliestStart < v.LatestEnd {
+					clusterVehicles = append(clusterVehicles, v)
+				}
+			}
+			if len(clusterVehicles) == 0 {
+				for _, ship := range cluster {
+					merged.Solution.Unassigned.Shipments = append(merged.Solution.Unassigned.Shipments, ship.Id)
+				}
+				continue
+			}
+			sol, err := s.solveApi(ctx, Problem{clusterVehicles, prob.VehicleTypes, cluster})
+			if err != nil {
+				return merged, err
+			}
+			mergeSolution(&merged, sol)
+		}
+		return merged, nil
+	}
+
+	for i := range vehicles {
+		err := s.solveInTurn(ctx, &merged, &vehicles[i], prob.VehicleTypes,
+			clusters[i*numClusters/numVehicles:(i+1)*numClusters/numVehicles])
+		if err != nil {
+			return merged, err
+		}
+	}
+	return merged, nil
+}
+
+// solveInTurn solves the clusters one after another with v, adding the routes to merged.
+// Each cluster starts when v is back from the previous one, which moves v.EarliestStart.
+func (s *Solver) solveInTurn(ctx context.Context, merged *Solution, v *Vehicle, types []VehicleType, clusters [][]Shipment) error {
+	for _, cluster := range clusters {
+		if v.EarliestStart >= v.LatestEnd {
+			for _, ship := range cluster {
+				merged.Solution.Unassigned.Shipments = append(merged.Solution.Unassigned.Shipments, ship.Id)
+			}
+			continue
+		}
+		sol, err := s.solveApi(ctx, Problem{[]Vehicle{*v}, types, cluster})
+		if err != nil {
+			return err
+		}
+		mergeSolution(merged, sol)
+		if end := routeEnd(sol, v.Id); end > v.EarliestStart {
+			v.EarliestStart = end
+		}
+	}
+	return nil
+}
+
+// bisectShipments recursively splits ships in two halves, along the wider axis
+// of their delivery points, until each part fits in maxLocs together with fixed.
+func bisectShipments(ships []Shipment, fixed map[string]bool, maxLocs int) [][]Shipment {
+	if len(ships) <= 1 || len(fixed)+numNewLocations(ships, fixed) <= maxLocs {
+		return [][]Shipment{ships}
+	}
+	minLat, maxLat := ships[0].Delivery.Address.Lat, ships[0].Delivery.Address.Lat
+	minLon, maxLon := ships[0].Delivery.Address.Lon, ships[0].Delivery.Address.Lon
+	for _, s := range ships {
+		a := s.Delivery.Address
+		if a.Lat < minLat {
+			minLat = a.Lat
+		}
+		if a.Lat > maxLat {
+			maxLat = a.Lat
+		}
+		if a.Lon < minLon {
+			minLon = a.Lon
+		}
+		if a.Lon > maxLon {
+			maxLon = a.Lon
+		}
+	}
+	byLat := maxLat-minLat >= maxLon-minLon
+	sort.SliceStable(ships, func(i, j int) bool {
+		a, b := ships[i].Delivery.Address, ships[j].Delivery.Address
+		if byLat {
+			return a.Lat < b.Lat
+		}
+		return a.Lon < b.Lon
+	})
+	half := len(ships) / 2
+	return append(
+		bisectShipments(ships[:half], fixed, maxLocs),
+		bisectShipments(ships[half:], fixed, maxLocs)...,
+	)
+}
+
+// mergeSolution adds the routes and unassigned shipments of sol to dst.
+// Activities of a vehicle already in dst are appended to its route.
+func mergeSolution(dst *Solution, sol Solution) {
+	for _, r := range sol.Solution.Routes {
+		found := false
+		for i := range dst.Solution.Routes {
+			if dst.Solution.Routes[i].VehicleId == r.VehicleId {
+				dst.Solution.Routes[i].Activities = append(dst.Solution.Routes[i].Activities, r.Activities...)
+				dst.Solution.Routes[i].Distance += r.Distance
+				found = true
+				break
+			}
+		}
+		if !found {
+			dst.Solution.Routes = append(dst.Solution.Routes, r)
+		}
+	}
+	dst.Solution.Unassigned.Shipments = append(dst.Solution.Unassigned.Shipments, sol.Solution.Unassigned.Shipments...)
+}
+
+// routeEnd returns the time the vehicle completes its route in sol, 0 if it has none.
+func routeEnd(sol Solution, vehicleId string) int64 {
+	var end int64
+	for _, r := range sol.Solution.Routes {
+		if r.VehicleId != vehicleId {
+			continue
+		}
+		for _, act := range r.Activities {
+			if act.ArrivalTime > end {
+				end = act.ArrivalTime
+			}
+			if act.EndTime > end {
+				end = act.EndTime
+			}
+		}
+	}
+	return end
+}
@@ -0,0 +1,214 @@
+package vrp_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/robzan8/taac/fake"
+	"github.com/robzan8/taac/vrp"
+)
+
+const testShiftStart = 1700000000 // unix time
+
+// newTestSolver returns a solver using the fake API, which refuses problems over maxLocs.
+func newTestSolver(t *testing.T, maxLocs int) (*vrp.Solver, *fake.Services) {
+	t.Helper()
+	s := fake.Start()
+	t.Cleanup(s.Close)
+	s.Solver.MaxLocations = maxLocs
+	conf := vrp.DefaultConfig()
+	conf.Url, conf.Key, conf.MaxLocations = s.VrpUrl(), "fake", maxLocs
+	return vrp.NewSolver(conf), s
+}
+
+var depot = vrp.Address{Str: "Piazza Duomo Milano", Lat: 45.4642, Lon: 9.1900}
+
+func testVehicle(id string) vrp.Vehicle {
+	return vrp.Vehicle{
+		Id:            id,
+		Type:          vrp.CargoBike.Id,
+		StartAddress:  depot,
+		EarliestStart: testShiftStart,
+		LatestEnd:     testShiftStart + 10*3600,
+	}
+}
+
+// testShipment goes from the depot to a point dLon degrees east of it.
+func testShipment(id string, dLon float64) vrp.Shipment {
+	dest := vrp.Address{Str: fmt.Sprintf("Delivery %s", id), Lat: depot.Lat, Lon: depot.Lon + dLon}
+	return vrp.Shipment{
+		Id:       id,
+		Size:     [1]int{10},
+		Pickup:   vrp.Delivery{Address: depot, PrepTime: 60},
+		Delivery: vrp.Delivery{Address: dest, PrepTime: 60},
+	}
+}
+
+// routeOf maps each assigned shipment to its vehicle.
+func routeOf(sol vrp.Solution) map[string]string {
+	vehicles := make(map[string]string)
+	for _, r := range sol.Solution.Routes {
+		for _, act := range r.Activities {
+			if act.Type == vrp.ActivityTypeDeliver {
+				vehicles[act.ShipmentId] = r.VehicleId
+			}
+		}
+	}
+	return vehicles
+}
+
+// The clusters split the shipments west to east, while the riders
+// are pinned to the opposite side: they must keep their shipments.
+func TestSolveDecomposedKeepsPinnedShipments(t *testing.T) {
+	solver, _ := newTestSolver(t, 5)
+	prob := vrp.Problem{
+		Vehicles:     []vrp.Vehicle{testVehicle("west-rider"), testVehicle("east-rider")},
+		VehicleTypes: []vrp.VehicleType{vrp.CargoBike},
+	}
+	pins := make(map[string]string)
+	for i := 0; i < 6; i++ {
+		ship := testShipment(fmt.Sprint(i), float64(i-3)*0.01)
+		if i < 3 {
+			ship.AllowedVehicles = []string{"east-rider"}
+		} else {
+			ship.AllowedVehicles = []string{"west-rider"}
+		}
+		ship.Priority = 1
+		pins[ship.Id] = ship.AllowedVehicles[0]
+		prob.Shipments = append(prob.Shipments, ship)
+	}
+	prob.Shipments = append(prob.Shipments, testShipment("free", 0.02))
+
+	sol, err := solver.Solve(context.Background(), prob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(sol.Solution.Unassigned.Shipments); n > 0 {
+		t.Errorf("unassigned shipments: %v", sol.Solution.Unassigned.Shipments)
+	}
+	got := routeOf(sol)
+	for id, vehicle := range pins {
+		if got[id] != vehicle {
+			t.Errorf("shipment %s went to %q, want %q", id, got[id], vehicle)
+		}
+	}
+	if got["free"] == "" {
+		t.Errorf("free shipment not assigned")
+	}
+}
+
+func testProblem(numVehicles, numShips int) vrp.Problem {
+	prob := vrp.Problem{VehicleTypes: []vrp.VehicleType{vrp.CargoBike}}
+	for i := 0; i < numVehicles; i++ {
+		prob.Vehicles = append(prob.Vehicles, testVehicle(fmt.Sprint("rider-", i)))
+	}
+	for i := 0; i < numShips; i++ {
+		prob.Shipments = append(prob.Shipments, testShipment(fmt.Sprint(i), float64(i+1)*0.005))
+	}
+	return prob
+}
+
+// checkAssigned fails t unless every shipment of prob is in a route of sol.
+func checkAssigned(t *testing.T, prob vrp.Problem, sol vrp.Solution) {
+	t.Helper()
+	if len(sol.Solution.Unassigned.Shipments) > 0 {
+		t.Errorf("unassigned shipments: %v", sol.Solution.Unassigned.Shipments)
+	}
+	routes := routeOf(sol)
+	for _, ship := range prob.Shipments {
+		if routes[ship.Id] == "" {
+			t.Errorf("shipment %s not in any route", ship.Id)
+		}
+	}
+}
+
+// The depot and 4 deliveries fit in 5 locations, a fifth delivery does not.
+func TestSolveSplitsAboveMaxLocations(t *testing.T) {
+	for _, test := range []struct {
+		numShips, wantProblems int
+	}{
+		{4, 1},
+		{5, 2},
+	} {
+		solver, s := newTestSolver(t, 5)
+		prob := testProblem(2, test.numShips)
+		sol, err := solver.Solve(context.Background(), prob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkAssigned(t, prob, sol)
+		if n := len(s.Solver.Problems()); n != test.wantProblems {
+			t.Errorf("%d shipments: solved in %d problems, want %d", test.numShips, n, test.wantProblems)
+		}
+	}
+}
+
+// With more clusters than vehicles, the only vehicle serves them in turn:
+// each cluster starts when the previous one is done.
+func TestSolveDecomposedOneVehicle(t *testing.T) {
+	solver, s := newTestSolver(t, 3)
+	prob := testProblem(1, 8)
+	sol, err := solver.Solve(context.Background(), prob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAssigned(t, prob, sol)
+
+	problems := s.Solver.Problems()
+	if len(problems) != 4 {
+		t.Fatalf("solved in %d clusters, want 4", len(problems))
+	}
+	for i := 1; i < len(problems); i++ {
+		if prev, cur := problems[i-1].Vehicles[0], problems[i].Vehicles[0]; cur.EarliestStart <= prev.EarliestStart {
+			t.Errorf("cluster %d starts at %d, not after cluster %d at %d", i, cur.EarliestStart, i-1, prev.EarliestStart)
+		}
+	}
+	var last int64
+	for _, act := range sol.Solution.Routes[0].Activities {
+		at := act.ArrivalTime // the start has only an end time, the end only an arrival
+		if act.EndTime > at {
+			at = act.EndTime
+		}
+		if at < last {
+			t.Fatalf("the route goes back in time at %+v", act)
+		}
+		last = at
+	}
+}
+
+// The clusters follow the deliveries, far from their pickups:
+// each shipment must still be picked up and delivered in the same route.
+func TestSolveDecomposedKeepsPickupAndDelivery(t *testing.T) {
+	solver, s := newTestSolver(t, 5)
+	prob := testProblem(2, 6)
+	for i := range prob.Shipments {
+		p := &prob.Shipments[i].Pickup.Address
+		p.Str = fmt.Sprint("Pickup ", i)
+		p.Lat += float64(5-i) * 0.005
+	}
+	sol, err := solver.Solve(context.Background(), prob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAssigned(t, prob, sol)
+	for _, p := range s.Solver.Problems() {
+		if n := vrp.NumLocations(p); n > 5 {
+			t.Errorf("cluster with %d locations", n)
+		}
+	}
+
+	pickedUp := make(map[string]string) // vehicle by shipment
+	for _, r := range sol.Solution.Routes {
+		for _, act := range r.Activities {
+			switch act.Type {
+			case vrp.ActivityTypePickup:
+				pickedUp[act.ShipmentId] = r.VehicleId
+			case vrp.ActivityTypeDeliver:
+				if pickedUp[act.ShipmentId] != r.VehicleId {
+					t.Errorf("shipment %s delivered by %s, not picked up by it before", act.ShipmentId, r.VehicleId)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Package vrp solves vehicle routing problems with pickups and deliveries
+// through the GraphHopper route optimization API, or a compatible one.
+package vrp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Types of the activities of a route.
+const (
+	ActivityTypeStart   = "start"
+	ActivityTypeEnd     = "end"
+	ActivityTypePickup  = "pickupShipment"
+	ActivityTypeDeliver = "deliverShipment"
+)
+
+// A Problem is a request to the route optimization API.
+type Problem struct {
+	Vehicles     []Vehicle     `json:"vehicles"`
+	VehicleTypes []VehicleType `json:"vehicle_types"`
+	Shipments    []Shipment    `json:"shipments"`
+}
+
+// A Vehicle is a rider on a shift, from EarliestStart to LatestEnd, as unix timestamps.
+// It starts from StartAddress and returns there by LatestEnd, the default of the
+// API (return_to_depot): routes end with an "end" activity at StartAddress, and
+// their distance and duration include the ride back.
+type Vehicle struct {
+	Id            string  `json:"vehicle_id"`
+	Type          string  `json:"type_id"`
+	StartAddress  Address `json:"start_address"`
+	EarliestStart int64   `json:"earliest_start"`
+	LatestEnd     int64   `json:"latest_end"`
+}
+
+// An Address is identified by Str, the address as written.
+type Address struct {
+	Str string  `json:"location_id"`
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// CargoBike is the vehicle type used when none is configured.
+var CargoBike = VehicleType{
+	Id:          "cargo-bike",
+	Capacity:    [1]int{1000},
+	Profile:     "bike",
+	SpeedFactor: 0.7,
+}
+
+// A VehicleType defines the capacity and the routing profile of the vehicles of that type.
+type VehicleType struct {
+	Id          string  `json:"type_id" yaml:"type_id"`
+	Capacity    [1]int  `json:"capacity" yaml:"capacity"`
+	Profile     string  `json:"profile" yaml:"profile"`
+	SpeedFactor float64 `json:"speed_factor" yaml:"speed_factor"`
+}
+
+// A Shipment is picked up and delivered by the same vehicle. Higher priorities
+// are assigned first when not all shipments fit.
+type Shipment struct {
+	Id       string   `json:"id"`
+	Size     [1]int   `json:"size"`
+	Pickup   Delivery `json:"pickup"`
+	Delivery Delivery `json:"delivery"`
+	Priority int      `json:"priority,omitempty"`
+	// Vehicle ids the shipment can be assigned to, any if empty.
+	AllowedVehicles []string `json:"allowed_vehicles,omitempty"`
+}
+
+// A Delivery is a stop of a shipment, pickup or delivery. PrepTime is spent there, in seconds.
+type Delivery struct {
+	Address     Address      `json:"address"`
+	PrepTime    int64        `json:"preparation_time"`
+	TimeWindows []TimeWindow `json:"time_windows,omitempty"`
+}
+
+// A TimeWindow is a range of unix timestamps.
+type TimeWindow struct {
+	Earliest int64 `json:"earliest"`
+	Latest   int64 `json:"latest"`
+}
+
+// A Solution is the response of the route optimization API.
+type Solution struct {
+	Solution struct {
+		Routes     []Route `json:"routes"`
+		Unassigned struct {
+			Shipments []string `json:"shipments"`
+		} `json:"unassigned"`
+	} `json:"solution"`
+}
+
+// A Route is the sequence of activities of a vehicle.
+type Route struct {
+	VehicleId  string     `json:"vehicle_id"`
+	Distance   int64      `json:"distance"` // in meters
+	Activities []Activity `json:"activities"`
+}
+
+// An Activity is a stop of a route. Times are unix timestamps.
+type Activity struct {
+	Type        string  `json:"type"`
+	ShipmentId  string  `json:"id"`
+	Address     Address `json:"address"`
+	ArrivalTime int64   `json:"arr_time"`
+	EndTime     int64   `json:"end_time"`
+}
+
+// Config configures a Solver.
+type Config struct {
+	Url          string        `yaml:"url"`
+	Key          string        `yaml:"key"`
+	MaxLocations int           `yaml:"max_locations"` // 0 means no limit
+	Timeout      time.Duration `yaml:"timeout"`
+}
+
+// DefaultConfig is the configuration of the GraphHopper API, without the key.
+func DefaultConfig() Config {
+	return Config{
+		Url:          "https://graphhopper.com/api/1/vrp",
+		MaxLocations: 30, // GraphHopper free tier
+		Timeout:      90 * time.Second,
+	}
+}
+
+// A Solver solves problems with the API configured in Config.
+type Solver struct {
+	Config     Config
+	HTTPClient *http.Client
+
+	// If set, OnSolve is called with each problem given to Solve
+	// and OnCall after each call to the API, e.g. for metrics.
+	OnSolve func(prob Problem)
+	OnCall  func(start time.Time, err error)
+}
+
+// NewSolver returns a Solver for the API configured in conf, using http.DefaultClient.
+func NewSolver(conf Config) *Solver {
+	return &Solver{Config: conf, HTTPClient: http.DefaultClient}
+}
+
+// Solve solves prob with the configured backend. Problems with more locations
+// than the backend supports are decomposed into smaller ones, see solveDecomposed.
+func (s *Solver) Solve(ctx context.Context, prob Problem) (Solution, error) {
+	if s.OnSolve != nil {
+		s.OnSolve(prob)
+	}
+	if maxLocs := s.Config.MaxLocations; maxLocs > 0 && NumLocations(prob) > maxLocs {
+		return s.solveDecomposed(ctx, prob, maxLocs)
+	}
+	return s.solveApi(ctx, prob)
+}
+
+func (s *Solver) solveApi(ctx context.Context, prob Problem) (sol Solution, err error) {
+	if s.OnCall != nil {
+		defer func(start time.Time) { s.OnCall(start, err) }(time.Now())
+	}
+
+	body, err := json.Marshal(&prob)
+	if err != nil {
+		return sol, err
+	}
+	postUrl := s.Config.Url + "?key=" + s.Config.Key
+	ctx, cancel := context.WithTimeout(ctx, s.Config.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, postUrl, bytes.NewReader(body))
+	if err != nil {
+		return sol, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.HTTPClient.Do(req)
+	if err != nil {
+		return sol, err
+	}
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return sol, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return sol, fmt.Errorf("Unexpected response with code %d:\n%s", resp.StatusCode, body)
+	}
+	err = json.Unmarshal(body, &sol)
+	return sol, err
+}